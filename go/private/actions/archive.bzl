@@ -58,6 +58,7 @@ def emit_archive(go, source = None, _recompile_suffix = "", recompile_internal_d
     # store export information for compiling dependent packages separately
     out_export = go.declare_file(go, name = source.name, ext = pre_ext + ".x")
     out_cgo_export_h = None  # set if cgo used in c-shared or c-archive mode
+    out_cgo_go_srcs = None  # set if cgo used
 
     nogo = get_nogo(go)
     if nogo:
@@ -100,6 +101,10 @@ def emit_archive(go, source = None, _recompile_suffix = "", recompile_internal_d
         )
         if go.mode.linkmode in (LINKMODE_C_SHARED, LINKMODE_C_ARCHIVE):
             out_cgo_export_h = go.declare_file(go, path = "_cgo_install.h")
+
+        # Go sources generated by cgo, for nogo and the packages driver. They
+        # are only generated when nogo runs or the packages driver asks for them.
+        out_cgo_go_srcs = go.declare_directory(go, path = out_lib.basename + ".cgo")
         cgo_deps = cgo.deps
         runfiles = runfiles.merge(cgo.runfiles)
         emit_compilepkg(
@@ -118,6 +123,7 @@ def emit_archive(go, source = None, _recompile_suffix = "", recompile_internal_d
             out_nogo_fix = out_nogo_fix,
             nogo = nogo,
             out_cgo_export_h = out_cgo_export_h,
+            out_cgo_go_srcs = out_cgo_go_srcs,
             gc_goopts = source.gc_goopts,
             cgo = True,
             cgo_inputs = cgo.inputs,
@@ -191,6 +197,7 @@ def emit_archive(go, source = None, _recompile_suffix = "", recompile_internal_d
         _validation_output = out_nogo_validation,
         _nogo_fix_output = out_nogo_fix,
         _cgo_deps = cgo_deps,
+        _cgo_go_srcs = out_cgo_go_srcs,
     )
     x_defs = dict(source.x_defs)
     for a in direct:
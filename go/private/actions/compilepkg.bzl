@@ -17,15 +17,15 @@ load(
     "//go/private:mode.bzl",
     "link_mode_arg",
 )
-load("//go/private/actions:utils.bzl", "quote_opts")
+load("//go/private/actions:utils.bzl", "escape_field", "quote_opts")
 
 def _archive(v):
     importpaths = [v.data.importpath]
     importpaths.extend(v.data.importpath_aliases)
     return "{}={}={}".format(
-        ":".join(importpaths),
-        v.data.importmap,
-        v.data.export_file.path if v.data.export_file else v.data.file.path,
+        ":".join([escape_field(p) for p in importpaths]),
+        escape_field(v.data.importmap),
+        escape_field(v.data.export_file.path if v.data.export_file else v.data.file.path),
     )
 
 def _facts(v):
@@ -35,9 +35,9 @@ def _facts(v):
     importpaths = [v.data.importpath]
     importpaths.extend(v.data.importpath_aliases)
     return "{}={}={}".format(
-        ":".join(importpaths),
-        v.data.importmap,
-        facts_file.path,
+        ":".join([escape_field(p) for p in importpaths]),
+        escape_field(v.data.importmap),
+        escape_field(facts_file.path),
     )
 
 def _embedroot_arg(src):
@@ -73,6 +73,7 @@ def emit_compilepkg(
         out_nogo_fix = None,
         nogo = None,
         out_cgo_export_h = None,
+        out_cgo_go_srcs = None,
         gc_goopts = [],
         testfilter = None,  # TODO: remove when test action compiles packages
         recompile_internal_deps = [],
@@ -176,27 +177,26 @@ def emit_compilepkg(
     else:
         env = go.env_for_path_mapping
         execution_requirements = SUPPORTS_PATH_MAPPING_REQUIREMENT
-    cgo_go_srcs_for_nogo = None
+    cgo_args = go.tool_args(go)
     if cgo:
-        if nogo:
-            cgo_go_srcs_for_nogo = go.declare_directory(go, path = out_lib.basename + ".cgo")
-            outputs.append(cgo_go_srcs_for_nogo)
-            compile_args.add("-cgo_go_srcs", cgo_go_srcs_for_nogo.path)
+        if out_cgo_go_srcs and nogo:
+            outputs.append(out_cgo_go_srcs)
+            compile_args.add("-cgo_go_srcs", out_cgo_go_srcs.path)
         inputs_transitive.append(cgo_inputs)
         inputs_transitive.append(go.cc_toolchain_files)
         env["CC"] = go.cgo_tools.c_compiler_path
         if cppopts:
-            compile_args.add("-cppflags", quote_opts(cppopts))
+            cgo_args.add("-cppflags", quote_opts(cppopts))
         if copts:
-            compile_args.add("-cflags", quote_opts(copts))
+            cgo_args.add("-cflags", quote_opts(copts))
         if cxxopts:
-            compile_args.add("-cxxflags", quote_opts(cxxopts))
+            cgo_args.add("-cxxflags", quote_opts(cxxopts))
         if objcopts:
-            compile_args.add("-objcflags", quote_opts(objcopts))
+            cgo_args.add("-objcflags", quote_opts(objcopts))
         if objcxxopts:
-            compile_args.add("-objcxxflags", quote_opts(objcxxopts))
+            cgo_args.add("-objcxxflags", quote_opts(objcxxopts))
         if clinkopts:
-            compile_args.add("-ldflags", quote_opts(clinkopts))
+            cgo_args.add("-ldflags", quote_opts(clinkopts))
 
     if go.mode.pgoprofile:
         compile_args.add("-pgoprofile", go.mode.pgoprofile)
@@ -207,18 +207,36 @@ def emit_compilepkg(
         outputs = outputs,
         mnemonic = "GoCompilePkgExternal" if is_external_pkg else "GoCompilePkg",
         executable = go.toolchain._builder,
-        arguments = ["compilepkg", shared_args, compile_args],
+        arguments = ["compilepkg", shared_args, compile_args, cgo_args],
         env = env,
         toolchain = GO_TOOLCHAIN_LABEL,
         execution_requirements = execution_requirements,
     )
 
+    if cgo and out_cgo_go_srcs and not nogo:
+        # Without nogo, only the packages driver reads the sources generated by
+        # cgo. They come from their own action, so that it only runs when they
+        # are requested.
+        cgo_go_srcs_args = go.tool_args(go)
+        cgo_go_srcs_args.add("-cgo_go_srcs_only")
+        cgo_go_srcs_args.add("-cgo_go_srcs", out_cgo_go_srcs.path)
+        go.actions.run(
+            inputs = depset(inputs_direct, transitive = inputs_transitive),
+            outputs = [out_cgo_go_srcs],
+            mnemonic = "GoCgoGoSrcs",
+            executable = go.toolchain._builder,
+            arguments = ["compilepkg", shared_args, cgo_go_srcs_args, cgo_args],
+            env = env,
+            toolchain = GO_TOOLCHAIN_LABEL,
+            execution_requirements = execution_requirements,
+        )
+
     if nogo:
         _run_nogo(
             go,
             shared_args = shared_args,
             sources = sources,
-            cgo_go_srcs = cgo_go_srcs_for_nogo,
+            cgo_go_srcs = out_cgo_go_srcs,
             archives = archives,
             out_facts = out_facts,
             out_log = out_nogo_log,
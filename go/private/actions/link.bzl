@@ -33,9 +33,14 @@ load(
     "//go/private:rpath.bzl",
     "rpath",
 )
+load("//go/private/actions:utils.bzl", "escape_field")
 
 def _format_archive(d):
-    return "{}={}={}".format(d.label, d.importmap, d.file.path)
+    return "{}={}={}".format(
+        escape_field(str(d.label)),
+        escape_field(d.importmap),
+        escape_field(d.file.path),
+    )
 
 def emit_link(
         go,
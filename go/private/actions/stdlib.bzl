@@ -62,7 +62,9 @@ def _should_use_sdk_stdlib(go):
             not go.mode.gc_goopts and
             go.mode.linkmode == LINKMODE_NORMAL)
 
-def _build_stdlib_list_json(go):
+def _build_stdlib_list_json(go, export_root):
+    # export_root is the GOROOT the archives of the standard library are
+    # installed in, so that the packages driver can report them as export data.
     sdk = go.sdk
 
     out = go.declare_file(go, "stdlib.pkg.json")
@@ -71,6 +73,11 @@ def _build_stdlib_list_json(go):
     args.add("-sdk", sdk.root_file.dirname)
     args.add("-out", out)
     args.add("-cache", cache_dir.path)
+    args.add("-export_root", export_root)
+    if go.mode.race:
+        args.add("-race")
+    if go.mode.msan:
+        args.add("-msan")
 
     inputs_direct = [sdk.go]
     inputs_transitive = [sdk.headers, sdk.srcs, sdk.libs, sdk.tools]
@@ -88,6 +95,16 @@ def _build_stdlib_list_json(go):
     )
     return out
 
+def _build_stdlib_sizes_json(go):
+    # The arguments of types.SizesFor for the target platform, so that the
+    # packages driver doesn't have to assume the host's.
+    out = go.declare_file(go, "stdlib.sizes.json")
+    go.actions.write(out, content = json.encode({
+        "Compiler": "gc",
+        "Arch": go.mode.goarch,
+    }))
+    return out
+
 def _build_env(go):
     env = go.env
 
@@ -116,7 +133,8 @@ def _build_env(go):
 
 def _sdk_stdlib(go):
     return GoStdLib(
-        _list_json = _build_stdlib_list_json(go),
+        _list_json = _build_stdlib_list_json(go, go.sdk.root_file.dirname),
+        _sizes_json = _build_stdlib_sizes_json(go),
         libs = go.sdk.libs,
         root_file = go.sdk.root_file,
     )
@@ -165,7 +183,8 @@ def _build_stdlib(go):
         execution_requirements = SUPPORTS_PATH_MAPPING_REQUIREMENT,
     )
     return GoStdLib(
-        _list_json = _build_stdlib_list_json(go),
+        _list_json = _build_stdlib_list_json(go, pkg.dirname),
+        _sizes_json = _build_stdlib_sizes_json(go),
         libs = depset([pkg]),
         root_file = pkg,
     )
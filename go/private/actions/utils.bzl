@@ -5,3 +5,14 @@ load(
 
 def quote_opts(opts):
     return " ".join([shell.quote(opt) if " " in opt else opt for opt in opts])
+
+def escape_field(s, separators = "=:"):
+    """Escapes a field of a flag value made of several separated fields.
+
+    Backslashes and the separators are escaped with a backslash, which the
+    builders undo when splitting the value (see go/tools/builders/escape.go).
+    """
+    s = s.replace("\\", "\\\\")
+    for sep in separators.elems():
+        s = s.replace(sep, "\\" + sep)
+    return s
@@ -154,15 +154,13 @@ def _go_binary_impl(ctx):
     validation_output = archive.data._validation_output
     nogo_fix_output = archive.data._nogo_fix_output
 
-    providers = [
-        archive,
-        OutputGroupInfo(
-            cgo_exports = archive.cgo_exports,
-            compilation_outputs = [archive.data.file],
-            nogo_fix = [nogo_fix_output] if nogo_fix_output else [],
-            _validation = [validation_output] if validation_output else [],
-        ),
-    ]
+    output_groups = {
+        "cgo_exports": archive.cgo_exports,
+        "compilation_outputs": [archive.data.file],
+        "nogo_fix": [nogo_fix_output] if nogo_fix_output else [],
+        "_validation": [validation_output] if validation_output else [],
+    }
+    providers = [archive]
 
     if go.mode.linkmode in LINKMODES_EXECUTABLE:
         env = {}
@@ -206,6 +204,7 @@ def _go_binary_impl(ctx):
                 target_file = cgo_exports[0],
             )
             cc_import_kwargs["hdrs"] = depset([header])
+            output_groups["c_header"] = [header]
         if go.mode.linkmode == LINKMODE_C_SHARED:
             cc_import_kwargs["dynamic_library"] = executable
         elif go.mode.linkmode == LINKMODE_C_ARCHIVE:
@@ -218,6 +217,7 @@ def _go_binary_impl(ctx):
         ccinfo = cc_common.merge_cc_infos(cc_infos = cc_infos)
         providers.append(ccinfo)
 
+    providers.append(OutputGroupInfo(**output_groups))
     return providers
 
 def _go_binary_kwargs(go_cc_aspects = []):
@@ -434,6 +434,9 @@ def _go_binary_kwargs(go_cc_aspects = []):
                 <li>`c-shared`: Builds a shared library that can be linked into a C program.</li>
                 <li>`c-archive`: Builds an archive that can be linked into a C program.</li>
                 </ul>
+                With `c-shared` and `c-archive`, the binary provides `CcInfo`, so that C and C++ rules
+                can depend on it. The header declaring its exported functions is also in the
+                `c_header` output group.
                 """,
             ),
             "pgoprofile": attr.label(
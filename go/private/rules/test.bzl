@@ -77,6 +77,8 @@ def _go_test_impl(ctx):
         ctx.attr,
         testfilter = "exclude",
     )
+    if ctx.attr.fuzz:
+        internal_go_info = _with_fuzz_instrumentation(internal_go_info)
     internal_archive = go.archive(go, internal_go_info)
     if internal_archive.data._validation_output:
         validation_outputs.append(internal_archive.data._validation_output)
@@ -98,6 +100,8 @@ def _go_test_impl(ctx):
         importpath = internal_go_info.importpath + "_test",
         testfilter = "only",
     )
+    if ctx.attr.fuzz:
+        external_go_info = _with_fuzz_instrumentation(external_go_info)
     external_go_info, internal_archive = _recompile_external_deps(go, external_go_info, internal_archive, [t.label for t in ctx.attr.embed])
     external_archive = go.archive(go, external_go_info, is_external_pkg = True)
     if external_archive.data._validation_output:
@@ -191,10 +195,27 @@ def _go_test_impl(ctx):
         version_file = ctx.version_file,
         info_file = ctx.info_file,
     )
+    if go.mode.goos == "wasip1":
+        # The test binary is a WebAssembly module, which the host can't
+        # execute. Run it with a WASI runtime instead.
+        wasm = executable
+        executable = go.declare_file(go, path = ctx.label.name + "_wasip1", ext = ".sh")
+        ctx.actions.write(
+            output = executable,
+            content = _WASIP1_LAUNCHER.format(
+                wasm = _rlocationpath(ctx, wasm),
+            ),
+            is_executable = True,
+        )
+        runfiles = runfiles.merge(ctx.runfiles([wasm]))
 
     env = {}
     for k, v in ctx.attr.env.items():
-        env[k] = ctx.expand_location(v, ctx.attr.data)
+        env[k] = _expand_make_variables(ctx, ctx.expand_location(v, ctx.attr.data))
+    if ctx.attr.fuzz:
+        # Read by the generated test main, see generate_test_main.go.
+        env["GO_TEST_FUZZ"] = ctx.attr.fuzz
+        env["GO_TEST_FUZZTIME"] = ctx.attr.fuzztime
 
     run_environment_info = RunEnvironmentInfo(env, ctx.attr.env_inherit)
 
@@ -277,14 +298,30 @@ _go_test_kwargs = {
         "env": attr.string_dict(
             doc = """Environment variables to set for the test execution.
             The values (but not keys) are subject to
-            [location expansion](https://docs.bazel.build/versions/main/skylark/macros.html) but not full
-            [make variable expansion](https://docs.bazel.build/versions/main/be/make-variables.html).
+            [location expansion](https://docs.bazel.build/versions/main/skylark/macros.html), and
+            `$(VAR)` references to [make variables](https://docs.bazel.build/versions/main/be/make-variables.html)
+            are replaced with their values. Any other `$` is kept as is.
             """,
         ),
         "env_inherit": attr.string_list(
             doc = """Environment variables to inherit from the external environment.
             """,
         ),
+        "fuzz": attr.string(
+            doc = """A regular expression matching the fuzz target to run, like `go test -fuzz`.
+            When set, the package under test is compiled with coverage instrumentation for
+            fuzzing, and the test fuzzes the matching target for `fuzztime` after running the
+            other tests. Seed inputs under `testdata/fuzz` must be listed in `data`. The inputs
+            found while fuzzing, including the failing ones, are saved to the undeclared outputs
+            of the test.
+            """,
+        ),
+        "fuzztime": attr.string(
+            default = "10s",
+            doc = """How long to fuzz for when `fuzz` is set, like `go test -fuzztime`.
+            It may be overridden with `--test_arg=-test.fuzztime=1m`.
+            """,
+        ),
         "importpath": attr.string(
             doc = """The import path of this test. Tests can't actually be imported, but this
             may be used by [go_path] and other tools to report the location of source
@@ -499,6 +536,11 @@ _go_test_kwargs = {
     the testbinary can be invoked with `-test.v` by setting
     `GO_TEST_WRAP_TESTV=1` in the test environment; this will result in the
     `XML_OUTPUT_FILE` containing more granular data.<br><br>
+    Tests built for wasip1, for example with
+    `--platforms=@io_bazel_rules_go//go/toolchain:wasip1_wasm`, are run with the
+    WASI runtime named by `GOWASIRUNTIME` in the test environment: `wasmtime`
+    (the default), `wazero` or `wasmedge`. The runtime must be in `PATH`. These
+    tests don't use the wrapper, since WASI can't start processes.<br><br>
     ***Note:*** To interoperate cleanly with old targets generated by [Gazelle], `name`
     should be `go_default_test` for internal tests and
     `go_default_xtest` for external tests. Gazelle now generates
@@ -510,6 +552,75 @@ _go_test_kwargs = {
 
 go_test = rule(**_go_test_kwargs)
 
+def _expand_make_variables(ctx, value):
+    # Only $(VAR) references to known make variables are expanded, so that
+    # values with a literal $ keep working without having to be escaped.
+    parts = value.split("$(")
+    expanded = parts[0]
+    for part in parts[1:]:
+        name, sep, rest = part.partition(")")
+        if sep and name in ctx.var:
+            expanded += ctx.var[name] + rest
+        else:
+            expanded += "$(" + part
+    return expanded
+
+def _rlocationpath(ctx, file):
+    """Returns the path of file in the runfiles, like $(rlocationpath)."""
+    if file.short_path.startswith("../"):
+        return file.short_path[len("../"):]
+    return ctx.workspace_name + "/" + file.short_path
+
+# Runs a wasip1 test binary with the WASI runtime named by GOWASIRUNTIME, like
+# lib/wasm/go_wasip1_wasm_exec in the Go distribution. The runtime must be in
+# PATH. The whole file system and environment are made available to the test,
+# and PWD tells it the working directory.
+_WASIP1_LAUNCHER = """#!/usr/bin/env bash
+set -euo pipefail
+rlocation="{wasm}"
+if [[ -n "${{RUNFILES_DIR:-}}" ]]; then
+  wasm="$RUNFILES_DIR/$rlocation"
+elif [[ -n "${{TEST_SRCDIR:-}}" ]]; then
+  wasm="$TEST_SRCDIR/$rlocation"
+elif [[ -f "${{RUNFILES_MANIFEST_FILE:-}}" ]]; then
+  wasm="$(grep -m1 "^$rlocation " "$RUNFILES_MANIFEST_FILE" | cut -d" " -f2-)"
+else
+  wasm="$0.runfiles/$rlocation"
+fi
+env_args=()
+for name in $(compgen -e); do
+  env_args+=(--env "$name=${{!name}}")
+done
+env_args+=(--env "PWD=$PWD")
+case "${{GOWASIRUNTIME:-wasmtime}}" in
+  wasmtime)
+    exec wasmtime run --dir=/ "${{env_args[@]}}" -W max-wasm-stack=1048576 ${{GOWASIRUNTIMEARGS:-}} "$wasm" "$@"
+    ;;
+  wazero)
+    exec wazero run -mount /:/ -env-inherit -cachedir "${{TMPDIR:-/tmp}}/wazero" ${{GOWASIRUNTIMEARGS:-}} "$wasm" "$@"
+    ;;
+  wasmedge)
+    exec wasmedge --dir=/ "${{env_args[@]}}" ${{GOWASIRUNTIMEARGS:-}} "$wasm" "$@"
+    ;;
+  *)
+    echo "unknown GOWASIRUNTIME: $GOWASIRUNTIME" >&2
+    exit 1
+    ;;
+esac
+"""
+
+def _with_fuzz_instrumentation(go_info):
+    """Returns go_info compiled with the instrumentation go test -fuzz adds.
+
+    Unlike the go command, which also instruments the dependencies, only the
+    packages of the test are instrumented: their archives are the only ones
+    compiled for the test alone. This guides the fuzzer through the code under
+    test, but not through the libraries it calls.
+    """
+    attrs = structs.to_dict(go_info)
+    attrs["gc_goopts"] = attrs["gc_goopts"] + ["-d=libfuzzer"]
+    return GoInfo(**attrs)
+
 def _recompile_external_deps(go, external_go_info, internal_archive, library_labels):
     """Recompiles some archives in order to split internal and external tests.
 
@@ -41,6 +41,7 @@ func compilePkg(args []string) error {
 	var importPath, packagePath, packageListPath, coverMode string
 	var outLinkobjPath, outInterfacePath, cgoExportHPath, cgoGoSrcsPath string
 	var testFilter string
+	var cgoGoSrcsOnly bool
 	var gcFlags, asmFlags, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags quoteMultiFlag
 	var coverFormat string
 	var pgoprofile string
@@ -65,7 +66,8 @@ func compilePkg(args []string) error {
 	fs.StringVar(&outLinkobjPath, "lo", "", "The full output archive file required by the linker")
 	fs.StringVar(&outInterfacePath, "o", "", "The export-only output archive required to compile dependent packages")
 	fs.StringVar(&cgoExportHPath, "cgoexport", "", "The _cgo_exports.h file to write")
-	fs.StringVar(&cgoGoSrcsPath, "cgo_go_srcs", "", "The directory to emit cgo-generated Go sources for nogo consumption to")
+	fs.StringVar(&cgoGoSrcsPath, "cgo_go_srcs", "", "The directory to emit cgo-generated Go sources for nogo and the packages driver to")
+	fs.BoolVar(&cgoGoSrcsOnly, "cgo_go_srcs_only", false, "Only emit the cgo-generated Go sources to -cgo_go_srcs, without compiling the package")
 	fs.StringVar(&testFilter, "testfilter", "off", "Controls test package filtering")
 	fs.StringVar(&coverFormat, "cover_format", "", "Emit source file paths in coverage instrumentation suitable for the specified coverage format")
 	fs.Var(&recompileInternalDeps, "recompile_internal_deps", "The import path of the direct dependencies that needs to be recompiled.")
@@ -103,6 +105,10 @@ func compilePkg(args []string) error {
 		return err
 	}
 
+	if cgoGoSrcsOnly {
+		return emitCgoGoSrcs(goenv, packagePath, srcs, cgoEnabled, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags, cgoGoSrcsPath)
+	}
+
 	return compileArchive(
 		goenv,
 		importPath,
@@ -134,6 +140,43 @@ func compilePkg(args []string) error {
 		pgoprofile)
 }
 
+// emitCgoGoSrcs writes the Go sources cgo generates from srcs to cgoGoSrcsPath,
+// for the packages driver to report when nogo doesn't run.
+func emitCgoGoSrcs(
+	goenv *env,
+	packagePath string,
+	srcs archiveSrcs,
+	cgoEnabled bool,
+	cc string,
+	cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags []string,
+	cgoGoSrcsPath string,
+) error {
+	if err := os.MkdirAll(cgoGoSrcsPath, 0o777); err != nil {
+		return err
+	}
+	var goSrcs, cgoSrcs []string
+	for _, src := range srcs.goSrcs {
+		if src.isCgo {
+			cgoSrcs = append(cgoSrcs, src.filename)
+		} else {
+			goSrcs = append(goSrcs, src.filename)
+		}
+	}
+	haveCgo := len(cgoSrcs)+len(srcs.cSrcs)+len(srcs.cxxSrcs)+len(srcs.objcSrcs)+len(srcs.objcxxSrcs) > 0
+	if len(srcs.goSrcs) == 0 || !haveCgo || !cgoEnabled {
+		return nil
+	}
+	filenames := func(files []fileInfo) []string {
+		names := make([]string, len(files))
+		for i, f := range files {
+			names[i] = f.filename
+		}
+		return names
+	}
+	_, _, _, err := cgo2(goenv, goSrcs, cgoSrcs, filenames(srcs.cSrcs), filenames(srcs.cxxSrcs), filenames(srcs.objcSrcs), filenames(srcs.objcxxSrcs), filenames(srcs.sSrcs), filenames(srcs.hSrcs), packagePath, srcs.goSrcs[0].pkg, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags, "", cgoGoSrcsPath)
+	return err
+}
+
 func compileArchive(
 	goenv *env,
 	importPath string,
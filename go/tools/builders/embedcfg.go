@@ -206,6 +206,15 @@ func (n *embedNode) isDir() bool {
 	return n.children != nil
 }
 
+// isModuleRoot returns whether n is a directory containing a go.mod file.
+func isModuleRoot(n *embedNode) bool {
+	if n == nil || !n.isDir() {
+		return false
+	}
+	goMod := n.children["go.mod"]
+	return goMod != nil && !goMod.isDir()
+}
+
 // get returns a tree node, given a slash-separated path relative to the
 // receiver. get returns nil if no node exists with that path.
 func (n *embedNode) get(path string) *embedNode {
@@ -316,15 +325,18 @@ func resolveEmbed(embed fileEmbed, root *embedNode) (matchedPaths, matchedFiles
 			return nil
 		}
 
-		// TODO: Should check that directories along path do not begin a new module
-		// (do not contain a go.mod).
+		// Check that the match and the directories along its path have valid
+		// names and do not begin a new module (do not contain a go.mod).
 		// https://cs.opensource.google/go/go/+/master:src/cmd/go/internal/load/pkg.go;l=2158;drc=261fe25c83a94fc3defe064baed3944cd3d16959
-		for dir := matchRel; len(dir) > 1; dir = filepath.Dir(dir) {
-			if base := path.Base(matchRel); isBadEmbedName(base) {
-				what := "file"
-				if matchNode.isDir() {
-					what = "directory"
-				}
+		what := "file"
+		if matchNode.isDir() {
+			what = "directory"
+		}
+		for dir := matchRel; len(dir) > 1; dir = path.Dir(dir) {
+			if isModuleRoot(root.get(dir)) {
+				return fmt.Errorf("cannot embed %s %s: in different module", what, matchRel)
+			}
+			if base := path.Base(dir); isBadEmbedName(base) {
 				if dir == matchRel {
 					return fmt.Errorf("cannot embed %s %s: invalid name %s", what, matchRel, base)
 				} else {
@@ -345,9 +357,11 @@ func resolveEmbed(embed fileEmbed, root *embedNode) (matchedPaths, matchedFiles
 		// unless "all:" prefix was set.
 		// See golang/go#42328.
 		matchTreeErr := matchNode.walk(func(childRel string, childNode *embedNode) error {
-			// TODO: Should check that directories along path do not begin a new module
-			// https://cs.opensource.google/go/go/+/master:src/cmd/go/internal/load/pkg.go;l=2158;drc=261fe25c83a94fc3defe064baed3944cd3d16959
 			if childRel != "" {
+				// Skip directories that begin a new module.
+				if isModuleRoot(childNode) {
+					return errSkip
+				}
 				base := path.Base(childRel)
 				if isBadEmbedName(base) || (!matchAll && (strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_"))) {
 					if childNode.isDir() {
@@ -0,0 +1,70 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "strings"
+
+// Flags such as -arc pack several fields into one value, separated by single
+// characters. Fields may contain the separators, such as a file named a=b.go,
+// so the rules escape them and backslashes with a backslash; see escape_field
+// in go/private/actions/utils.bzl. Values without backslashes parse as
+// before.
+
+// splitEscaped splits s around the instances of sep that aren't escaped. The
+// fields keep their escapes, so that they can be split further around another
+// separator; unescapeField them once done.
+func splitEscaped(s string, sep byte) []string {
+	var fields []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// unescapeField removes the escapes from a field split by splitEscaped. A
+// trailing backslash is kept.
+func unescapeField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// escapeField escapes backslashes and the separators in seps in s, like
+// escape_field does.
+func escapeField(s, seps string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || strings.IndexByte(seps, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
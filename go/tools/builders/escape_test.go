@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitEscaped(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string
+	}{
+		{s: "a=b=c", want: []string{"a", "b", "c"}},
+		{s: "", want: []string{""}},
+		{s: `a\=b=c`, want: []string{"a=b", "c"}},
+		{s: `a\\=b`, want: []string{`a\`, "b"}},
+		{s: `a\:b=c`, want: []string{"a:b", "c"}},
+	} {
+		var got []string
+		for _, f := range splitEscaped(tc.s, '=') {
+			got = append(got, unescapeField(f))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("splitEscaped(%q): got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestEscapeFieldRoundTrip(t *testing.T) {
+	importPaths := []string{"example.com/a:b", `c\d`}
+	fields := []string{"", "example.com/a=b", `bazel-out/x\y=z.a`}
+	var escaped []string
+	for _, p := range importPaths {
+		escaped = append(escaped, escapeField(p, "=:"))
+	}
+	fields[0] = strings.Join(escaped, ":")
+	for i := 1; i < len(fields); i++ {
+		fields[i] = escapeField(fields[i], "=:")
+	}
+	v := strings.Join(fields, "=")
+
+	parts := splitEscaped(v, '=')
+	if len(parts) != 3 {
+		t.Fatalf("splitEscaped(%q): got %q, want 3 fields", v, parts)
+	}
+	var gotImportPaths []string
+	for _, p := range splitEscaped(parts[0], ':') {
+		gotImportPaths = append(gotImportPaths, unescapeField(p))
+	}
+	if !reflect.DeepEqual(gotImportPaths, importPaths) {
+		t.Errorf("got import paths %q, want %q", gotImportPaths, importPaths)
+	}
+	if got := unescapeField(parts[1]); got != "example.com/a=b" {
+		t.Errorf("got package path %q, want %q", got, "example.com/a=b")
+	}
+	if got := unescapeField(parts[2]); got != `bazel-out/x\y=z.a` {
+		t.Errorf("got file %q, want %q", got, `bazel-out/x\y=z.a`)
+	}
+}
@@ -101,6 +101,7 @@ import (
 {{if .TestMain}}
 	"reflect"
 {{end}}
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -155,8 +156,10 @@ func testsInShard() []testing.InternalTest {
 	if err != nil || shardIndex < 0 {
 		return allTests
 	}
+	// Only the tests that pass the filter are partitioned, so that each shard
+	// gets an even share of those that actually run.
 	tests := []testing.InternalTest{}
-	for i, t := range allTests {
+	for i, t := range filteredTests() {
 		if i % totalShards == shardIndex {
 			tests = append(tests, t)
 		}
@@ -164,6 +167,95 @@ func testsInShard() []testing.InternalTest {
 	return tests
 }
 
+// testFilters returns the -test.run and -test.skip patterns for the
+// --test_filter Bazel passes in TESTBRIDGE_TEST_ONLY. Filters starting with
+// "-" exclude tests.
+func testFilters() (run, skip string) {
+	filter := os.Getenv("TESTBRIDGE_TEST_ONLY")
+	if filter == "" {
+		return "", ""
+	}
+	var runTests, skipTests []string
+	for _, f := range strings.Split(filter, ",") {
+		if strings.HasPrefix(f, "-") {
+			skipTests = append(skipTests, f[1:])
+		} else {
+			runTests = append(runTests, f)
+		}
+	}
+	return strings.Join(runTests, "|"), strings.Join(skipTests, "|")
+}
+
+// filteredTests returns the tests -test.run and -test.skip leave to run at the
+// top level, using the filters from testFilters the way the testing package
+// does: their first slash-separated element matches top-level test names, and
+// a skip pattern with more elements only skips subtests. If a filter doesn't
+// compile, all tests are returned and the testing package reports the error.
+func filteredTests() []testing.InternalTest {
+	run, skip := testFilters()
+	var runRe, skipRe *regexp.Regexp
+	if run != "" {
+		re, err := regexp.Compile(splitRegexp(run)[0])
+		if err != nil {
+			return allTests
+		}
+		runRe = re
+	}
+	if skipElems := splitRegexp(skip); skip != "" && len(skipElems) == 1 {
+		re, err := regexp.Compile(skipElems[0])
+		if err != nil {
+			return allTests
+		}
+		skipRe = re
+	}
+	tests := []testing.InternalTest{}
+	for _, t := range allTests {
+		if runRe != nil && !runRe.MatchString(t.Name) {
+			continue
+		}
+		if skipRe != nil && skipRe.MatchString(t.Name) {
+			continue
+		}
+		tests = append(tests, t)
+	}
+	return tests
+}
+
+// splitRegexp splits s into the elements matching each level of subtests,
+// like the function of the same name in the testing package: slashes inside
+// brackets or parentheses, or escaped ones, don't separate elements.
+func splitRegexp(s string) []string {
+	var elems []string
+	cs, cp := 0, 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			cs++
+		case ']':
+			if cs--; cs < 0 {
+				cs = 0
+			}
+		case '(':
+			if cs == 0 {
+				cp++
+			}
+		case ')':
+			if cs == 0 {
+				cp--
+			}
+		case '\\':
+			i++
+		case '/':
+			if cs == 0 && cp == 0 {
+				elems = append(elems, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(elems, s[start:])
+}
+
 func main() {
 	if bzltestutil.ShouldWrap() {
 		err := bzltestutil.Wrap("{{.Pkgname}}")
@@ -189,29 +281,25 @@ func main() {
 	m := testing.MainStart(testDeps, testsInShard(), benchmarks, examples)
   {{end}}
 
-	if filter := os.Getenv("TESTBRIDGE_TEST_ONLY"); filter != "" {
-		filters := strings.Split(filter, ",")
-		var runTests []string
-		var skipTests []string
-
-		for _, f := range filters {
-			if strings.HasPrefix(f, "-") {
-				skipTests = append(skipTests, f[1:])
-			} else {
-				runTests = append(runTests, f)
-			}
-		}
-		if len(runTests) > 0 {
-			flag.Lookup("test.run").Value.Set(strings.Join(runTests, "|"))
-		}
-		if len(skipTests) > 0 {
-			flag.Lookup("test.skip").Value.Set(strings.Join(skipTests, "|"))
-		}
+	run, skip := testFilters()
+	if run != "" {
+		flag.Lookup("test.run").Value.Set(run)
+	}
+	if skip != "" {
+		flag.Lookup("test.skip").Value.Set(skip)
 	}
 
 	if failfast := os.Getenv("TESTBRIDGE_TEST_RUNNER_FAIL_FAST"); failfast != "" {
 		flag.Lookup("test.failfast").Value.Set("true")
 	}
+{{if .Version "go1.18"}}
+	fuzz := os.Getenv("GO_TEST_FUZZ")
+	if fuzz != "" {
+		flag.Lookup("test.fuzz").Value.Set(fuzz)
+		flag.Lookup("test.fuzztime").Value.Set(os.Getenv("GO_TEST_FUZZTIME"))
+		flag.Lookup("test.fuzzcachedir").Value.Set(bzltestutil.FuzzCacheDir())
+	}
+{{end}}
 {{if eq .CoverFormat "lcov"}}
 	panicOnExit0Flag := flag.Lookup("test.paniconexit0").Value
 	testDeps.OriginalPanicOnExit = panicOnExit0Flag.(flag.Getter).Get().(bool)
@@ -249,6 +337,13 @@ func main() {
 	{{/* See golang.org/issue/34129 and golang.org/cl/219639 */}}
 	res := int(reflect.ValueOf(m).Elem().FieldByName("exitCode").Int())
 	{{end}}
+{{if .Version "go1.18"}}
+	if fuzz != "" {
+		if err := bzltestutil.SaveFuzzInputs(); err != nil {
+			log.Print(err)
+		}
+	}
+{{end}}
 	os.Exit(res)
 }
 `
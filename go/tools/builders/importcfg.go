@@ -190,9 +190,8 @@ package with this path is linked.`,
 				arc.importPath,
 				prevLabel)
 		}
-		// TODO(zbarsky): The labels are empty, and `importPath` contains the label.
-		// The parsing is incorrect because arrchiveMultiFlag assuming the formatting from
-		// `compilepkg.bzl` but `_format_archive` in `link.bzl` formats differently.
+		// The -arc flags of the linker hold the label of each archive in
+		// place of its import paths, so importPath is the label.
 		depsSeen[arc.packagePath] = arc.importPath
 		fmt.Fprintf(buf, "packagefile %s=%s\n", arc.packagePath, arc.file)
 	}
@@ -256,16 +255,19 @@ func (m *archiveMultiFlag) String() string {
 }
 
 func (m *archiveMultiFlag) Set(v string) error {
-	parts := strings.Split(v, "=")
+	parts := splitEscaped(v, '=')
 	if len(parts) != 3 {
 		return fmt.Errorf("badly formed -arc flag: %s", v)
 	}
-	importPaths := strings.Split(parts[0], ":")
+	importPaths := splitEscaped(parts[0], ':')
+	for i := range importPaths {
+		importPaths[i] = unescapeField(importPaths[i])
+	}
 	a := archive{
 		importPath:        importPaths[0],
 		importPathAliases: importPaths[1:],
-		packagePath:       parts[1],
-		file:              abs(parts[2]),
+		packagePath:       unescapeField(parts[1]),
+		file:              abs(unescapeField(parts[2])),
 	}
 	*m = append(*m, a)
 	return nil
@@ -110,7 +110,7 @@ func runNogo(workDir string, nogoPath string, srcs, ignores []string, facts []ar
 	args = append(args, "-fix", outFixPath)
 	args = append(args, "-importcfg", importcfgPath)
 	for _, fact := range facts {
-		args = append(args, "-fact", fmt.Sprintf("%s=%s", fact.importPath, fact.file))
+		args = append(args, "-fact", fmt.Sprintf("%s=%s", escapeField(fact.importPath, "="), escapeField(fact.file, "=")))
 	}
 	args = append(args, "-x", outFactsPath)
 	for _, ignore := range ignores {
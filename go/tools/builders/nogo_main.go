@@ -73,7 +73,7 @@ func run(args []string) (error, int) {
 
 	factMap := factMultiFlag{}
 	flags := flag.NewFlagSet("nogo", flag.ExitOnError)
-	flags.Var(&factMap, "fact", "Import path and file containing facts for that library, separated by '=' (may be repeated)'")
+	flags.Var(&factMap, "fact", "Import path and file containing facts for that library, separated by '=' and with '=' and '\\' escaped by '\\' (may be repeated)")
 	importcfg := flags.String("importcfg", "", "The import configuration file")
 	packagePath := flags.String("p", "", "The package path (importmap) of the package being compiled")
 	xPath := flags.String("x", "", "The archive file where serialized facts should be written")
@@ -705,10 +705,10 @@ func (m *factMultiFlag) String() string {
 }
 
 func (m *factMultiFlag) Set(v string) error {
-	parts := strings.Split(v, "=")
+	parts := splitEscaped(v, '=')
 	if len(parts) != 2 {
 		return fmt.Errorf("badly formatted -fact flag: %s", v)
 	}
-	(*m)[parts[0]] = parts[1]
+	(*m)[unescapeField(parts[0])] = unescapeField(parts[1])
 	return nil
 }
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"go/build"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -62,6 +63,8 @@ type flatPackage struct {
 	OtherFiles      []string            `json:",omitempty"`
 	ExportFile      string              `json:",omitempty"`
 	Imports         map[string]string   `json:",omitempty"`
+	EmbedPatterns   []string            `json:",omitempty"`
+	EmbedFiles      []string            `json:",omitempty"`
 }
 
 type goListPackage struct {
@@ -158,7 +161,7 @@ func filterGoFiles(srcs []string, pathReplaceFn func(p string) string) []string
 	return ret
 }
 
-func flatPackageForStd(cloneBase string, pkg *goListPackage, pathReplaceFn func(p string) string) *flatPackage {
+func flatPackageForStd(cloneBase string, pkg *goListPackage, pathReplaceFn func(p string) string, exportFileFn func(target string) string) *flatPackage {
 	goFiles := absoluteSourcesPaths(cloneBase, pkg.Dir, pkg.GoFiles)
 	compiledGoFiles := absoluteSourcesPaths(cloneBase, pkg.Dir, pkg.CompiledGoFiles)
 
@@ -166,11 +169,13 @@ func flatPackageForStd(cloneBase string, pkg *goListPackage, pathReplaceFn func(
 		ID:              stdlibPackageID(pkg.ImportPath),
 		Name:            pkg.Name,
 		PkgPath:         pkg.ImportPath,
-		ExportFile:      outputBasePath(cloneBase, pkg.Target),
+		ExportFile:      exportFileFn(pkg.Target),
 		Imports:         map[string]string{},
 		Standard:        pkg.Standard,
 		GoFiles:         goFiles,
 		CompiledGoFiles: filterGoFiles(compiledGoFiles, pathReplaceFn),
+		EmbedPatterns:   pkg.EmbedPatterns,
+		EmbedFiles:      absoluteSourcesPaths(cloneBase, pkg.Dir, pkg.EmbedFiles),
 	}
 
 	// imports
@@ -203,6 +208,9 @@ func stdliblist(args []string) error {
 	goenv := envFlags(flags)
 	out := flags.String("out", "", "Path to output go list json")
 	cachePath := flags.String("cache", "", "Path to use for GOCACHE")
+	exportRoot := flags.String("export_root", "", "Path of the GOROOT holding the compiled standard library, relative to the execution root")
+	race := flags.Bool("race", false, "The standard library at -export_root is built with the race detector")
+	msan := flags.Bool("msan", false, "The standard library at -export_root is built with the memory sanitizer")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -275,6 +283,19 @@ func stdliblist(args []string) error {
 	if cgoEnabled {
 		listArgs = append(listArgs, "-compiled=true")
 	}
+	var listEnv []string
+	if *exportRoot != "" {
+		// Since Go 1.20, go list only reports where standard library packages
+		// are installed with installgoroot=all, which the stdlib action uses.
+		// -race and -msan select the same installation directory.
+		listEnv = append(listEnv, "GODEBUG="+appendGodebug(os.Getenv("GODEBUG"), "installgoroot=all"))
+		if *race {
+			listArgs = append(listArgs, "-race")
+		}
+		if *msan {
+			listArgs = append(listArgs, "-msan")
+		}
+	}
 
 	listArgs = append(listArgs, "-json", "builtin", "std", "runtime/cgo")
 
@@ -285,7 +306,11 @@ func stdliblist(args []string) error {
 	defer jsonFile.Close()
 
 	jsonData := &bytes.Buffer{}
-	if err := goenv.runCommandToFile(jsonData, os.Stderr, listArgs); err != nil {
+	cmd := exec.Command(listArgs[0], listArgs[1:]...)
+	cmd.Env = append(os.Environ(), listEnv...)
+	cmd.Stdout = jsonData
+	cmd.Stderr = os.Stderr
+	if err := runAndLogCommand(cmd, goenv.verbose); err != nil {
 		return err
 	}
 
@@ -298,15 +323,38 @@ func stdliblist(args []string) error {
 
 		return s
 	}
+	exportFileFn := func(target string) string {
+		return outputBasePath(cloneBase, target)
+	}
+	if *exportRoot != "" {
+		// Point at the archives of the stdlib action rather than at the clone
+		// of GOROOT go list runs in, which has the same layout.
+		exportFileFn = func(target string) string {
+			rel, err := filepath.Rel(abs(newGoRoot), target)
+			if target == "" || err != nil {
+				return ""
+			}
+			return filepath.Join("__BAZEL_EXECROOT__", *exportRoot, rel)
+		}
+	}
 	for decoder.More() {
 		var pkg *goListPackage
 		if err := decoder.Decode(&pkg); err != nil {
 			return err
 		}
-		if err := encoder.Encode(flatPackageForStd(cloneBase, pkg, pathReplaceFn)); err != nil {
+		if err := encoder.Encode(flatPackageForStd(cloneBase, pkg, pathReplaceFn, exportFileFn)); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// appendGodebug adds setting to the comma-separated GODEBUG value godebug.
+// The last of several values for a setting wins, so setting takes precedence.
+func appendGodebug(godebug, setting string) string {
+	if godebug == "" {
+		return setting
+	}
+	return godebug + "," + setting
+}
@@ -47,3 +47,43 @@ func Test_stdliblist(t *testing.T) {
 		}
 	}
 }
+
+func Test_stdliblist_exportRoot(t *testing.T) {
+	testDir := t.TempDir()
+	outJSON := filepath.Join(testDir, "out.json")
+
+	test_args := []string{
+		fmt.Sprintf("-out=%s", outJSON),
+		"-sdk=../go_sdk",
+		"-export_root=bazel-out/k8-fastbuild/bin/stdlib_",
+	}
+
+	// installgoroot=all is only set for go list, on top of what the caller set.
+	t.Setenv("GODEBUG", "gotypesalias=1")
+	if err := stdliblist(test_args); err != nil {
+		t.Errorf("calling stdliblist got err: %v", err)
+	}
+	if got := os.Getenv("GODEBUG"); got != "gotypesalias=1" {
+		t.Errorf("GODEBUG got %q after calling stdliblist, want %q", got, "gotypesalias=1")
+	}
+	f, err := os.Open(outJSON)
+	if err != nil {
+		t.Errorf("cannot open output json: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var result *flatPackage
+		if err := decoder.Decode(&result); err != nil {
+			t.Errorf("unable to decode output json: %v\n", err)
+		}
+
+		if result.PkgPath == "builtin" || result.PkgPath == "unsafe" {
+			// Neither is installed as an archive.
+			continue
+		}
+		if !strings.HasPrefix(result.ExportFile, "__BAZEL_EXECROOT__/bazel-out/k8-fastbuild/bin/stdlib_/pkg/") || !strings.HasSuffix(result.ExportFile, ".a") {
+			t.Errorf("export file should be an archive in the export root :%v", result)
+		}
+	}
+}
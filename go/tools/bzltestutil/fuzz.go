@@ -0,0 +1,89 @@
+// Copyright 2026 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// fuzzCorpusDir is where the testing package reads seed inputs from and
+// writes failing inputs to, relative to the working directory of the test.
+const fuzzCorpusDir = "testdata/fuzz"
+
+// outputsDir returns the directory Bazel keeps the undeclared outputs of the
+// test in, or a temporary directory when not running under bazel test.
+func outputsDir() string {
+	if dir := os.Getenv("TEST_UNDECLARED_OUTPUTS_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("TEST_TMPDIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// FuzzCacheDir returns the directory for -test.fuzzcachedir, where the inputs
+// that expand coverage are kept. It is among the undeclared outputs of the
+// test, so that the corpus can be reused.
+func FuzzCacheDir() string {
+	return filepath.Join(outputsDir(), "fuzzcache")
+}
+
+// SaveFuzzInputs copies the inputs the testing package wrote to
+// testdata/fuzz, such as those that made the fuzz target fail, to the
+// undeclared outputs of the test. The working directory of the test is in
+// the runfiles tree, which Bazel doesn't keep. Seed inputs are symlinks into
+// the runfiles and are skipped.
+func SaveFuzzInputs() error {
+	return filepath.Walk(fuzzCorpusDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		out := filepath.Join(outputsDir(), path)
+		if err := os.MkdirAll(filepath.Dir(out), 0o777); err != nil {
+			return fmt.Errorf("unable to save fuzz input %s: %v", path, err)
+		}
+		if err := copyFile(path, out); err != nil {
+			return fmt.Errorf("unable to save fuzz input %s: %v", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "Saved fuzz input %s to the undeclared outputs of the test\n", path)
+		return nil
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -163,7 +164,7 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase)
 		case "fail":
 			suite.Failures++
 			newCase.Failure = &xmlMessage{
-				Message:  "Failed",
+				Message:  failureMessage(c.output.String()),
 				Contents: c.output.String(),
 			}
 		case "pass":
@@ -179,3 +180,19 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase)
 	}
 	return &xmlTestSuites{Suites: []xmlTestSuite{suite}}
 }
+
+// logLineRe matches the lines t.Log, t.Error and friends write to the output
+// of a test, indented by its depth among subtests.
+var logLineRe = regexp.MustCompile(`^\s+(\S+\.go:\d+: .*)$`)
+
+// failureMessage returns the first line logged by a failed test, which is
+// usually what it failed on, so that it shows up in the summaries of test
+// results. The full output is still in the contents of the failure.
+func failureMessage(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if m := logLineRe.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	return "Failed"
+}
@@ -27,6 +27,8 @@ GoPkgInfo = provider()
 DEPS_ATTRS = [
     "deps",
     "embed",
+    # The dependencies of the generated main of a go_test, like bzltestutil.
+    "_testmain_additional_deps",
 ]
 
 PROTO_COMPILER_ATTRS = [
@@ -49,27 +51,50 @@ def file_path(f):
         prefix = "__BAZEL_OUTPUT_BASE__"
     return paths.join(prefix, f.path)
 
-def _go_archive_to_pkg(archive):
+def _cgo_go_srcs(archive):
+    return getattr(archive.data, "_cgo_go_srcs", None)
+
+def _go_archive_to_pkg(archive, id = None, pkg_path = None, for_test = None, imports = None):
     go_files = [
         file_path(src)
         for src in archive.data.srcs
         if src.path.endswith(".go")
     ]
+
+    # The directory of cgo-generated sources is expanded by the driver, which
+    # replaces the cgo sources with the files generated from them.
+    compiled_go_files = go_files
+    cgo_go_srcs = _cgo_go_srcs(archive)
+    if cgo_go_srcs:
+        compiled_go_files = go_files + [file_path(cgo_go_srcs)]
+    if imports == None:
+        imports = {
+            pkg.data.importpath: str(pkg.data.label)
+            for pkg in archive.direct
+        }
     return struct(
-        ID = str(archive.data.label),
-        PkgPath = archive.data.importpath,
+        ID = id or str(archive.data.label),
+        PkgPath = pkg_path or archive.data.importpath,
+        ForTest = for_test or "",
         ExportFile = file_path(archive.data.export_file),
         GoFiles = go_files,
-        CompiledGoFiles = go_files,
+        CompiledGoFiles = compiled_go_files,
         OtherFiles = [
             file_path(src)
             for src in archive.data.srcs
             if not src.path.endswith(".go")
         ],
-        Imports = {
-            pkg.data.importpath: str(pkg.data.label)
-            for pkg in archive.direct
+        Imports = imports,
+        EmbedFiles = [
+            file_path(src)
+            for src in archive.data._embedsrcs
+        ],
+        GeneratedFiles = {
+            file_path(src): str(src.owner)
+            for src in archive.data.srcs
+            if not src.is_source
         },
+        BuildTags = list(archive.source.mode.tags),
     )
 
 def make_pkg_json(ctx, name, pkg_info):
@@ -77,9 +102,66 @@ def make_pkg_json(ctx, name, pkg_info):
     ctx.actions.write(pkg_json_file, content = json.encode(pkg_info))
     return pkg_json_file
 
+def _go_test_pkgs(test_archive, testmain_deps):
+    """Returns the archives of a go_test along with their packages.
+
+    Like go list -test, the packages of a test binary are reported: the package
+    under test compiled with its internal test files ("pkg [pkg.test]" in go
+    list), the external test package ("pkg_test [pkg.test]") and the generated
+    test main ("pkg.test").
+
+    The GoArchive of a go_test is the generated test main. The archives
+    containing the test sources are among its direct dependencies and share the
+    label of the test. The external test package and the test main are reported
+    under "_xtest" and "_testmain" IDs, since their packages are distinct from
+    the package under test.
+
+    testmain_deps are the labels of the other dependencies of the test main
+    that the aspect visits.
+    """
+    internal = None
+    external = None
+    for dep_archive in test_archive.direct:
+        if dep_archive.data.label != test_archive.data.label:
+            continue
+        if not internal:
+            internal = dep_archive
+        elif dep_archive.data.importpath == internal.data.importpath + "_test":
+            external = dep_archive
+
+    if not internal:
+        return []
+    label = str(internal.data.label)
+    for_test = internal.data.importpath
+    pkgs = [(internal, _go_archive_to_pkg(internal, for_test = for_test))]
+    if external:
+        pkgs.append((external, _go_archive_to_pkg(external, label + "_xtest", for_test = for_test)))
+
+    # The test main imports both test packages, which share the label of the
+    # test, so their IDs are set explicitly. Its other dependencies, such as
+    # the test runner support in bzltestutil, are reported under their own
+    # labels. The coverage support added when collecting coverage isn't
+    # visited by the aspect, so it's left out, and the standard library
+    # imports are resolved by the driver.
+    imports = {internal.data.importpath: label}
+    if external:
+        imports[external.data.importpath] = label + "_xtest"
+    for dep_archive in test_archive.direct:
+        if dep_archive.data.label in testmain_deps:
+            imports[dep_archive.data.importpath] = str(dep_archive.data.label)
+    pkgs.append((test_archive, _go_archive_to_pkg(
+        test_archive,
+        label + "_testmain",
+        pkg_path = internal.data.importpath + ".test",
+        imports = imports,
+    )))
+    return pkgs
+
 def _go_pkg_info_aspect_impl(target, ctx):
-    # Fetch the stdlib JSON file from the inner most target
+    # Fetch the stdlib JSON files from the inner most target
     stdlib_json_file = None
+    sizes_json_file = None
+    stdlib_export_files = None
 
     transitive_json_files = []
     transitive_export_files = []
@@ -102,6 +184,8 @@ def _go_pkg_info_aspect_impl(target, ctx):
                 # Fetch the stdlib json from the first dependency
                 if not stdlib_json_file:
                     stdlib_json_file = pkg_info.stdlib_json_file
+                    sizes_json_file = pkg_info.sizes_json_file
+                    stdlib_export_files = pkg_info.stdlib_export_files
 
     pkg_json_files = []
     compiled_go_files = []
@@ -109,28 +193,30 @@ def _go_pkg_info_aspect_impl(target, ctx):
 
     if GoArchive in target:
         archive = target[GoArchive]
-        compiled_go_files.extend(archive.source.srcs)
-        export_files.append(archive.data.export_file)
-        pkg = _go_archive_to_pkg(archive)
-        pkg_json_files.append(make_pkg_json(ctx, archive.data.name, pkg))
-
         if ctx.rule.kind == "go_test":
-            for dep_archive in archive.direct:
-                # find the archive containing the test sources
-                if archive.data.label == dep_archive.data.label:
-                    pkg = _go_archive_to_pkg(dep_archive)
-                    pkg_json_files.append(make_pkg_json(ctx, dep_archive.data.name, pkg))
-                    compiled_go_files.extend(dep_archive.source.srcs)
-                    export_files.append(dep_archive.data.export_file)
-                    break
+            testmain_deps = [dep.label for dep in ctx.rule.attr._testmain_additional_deps]
+            pkgs = _go_test_pkgs(archive, testmain_deps)
+        else:
+            pkgs = [(archive, _go_archive_to_pkg(archive))]
+
+        for archive, pkg in pkgs:
+            compiled_go_files.extend(archive.source.srcs)
+            if _cgo_go_srcs(archive):
+                compiled_go_files.append(_cgo_go_srcs(archive))
+            export_files.append(archive.data.export_file)
+            pkg_json_files.append(make_pkg_json(ctx, archive.data.name, pkg))
 
     # If there was no stdlib json in any dependencies, fetch it from the
     # current go_ node.
     if not stdlib_json_file:
         stdlib_json_file = ctx.attr._go_stdlib[GoStdLib]._list_json
+        sizes_json_file = ctx.attr._go_stdlib[GoStdLib]._sizes_json
+        stdlib_export_files = ctx.attr._go_stdlib[GoStdLib].libs
 
     pkg_info = GoPkgInfo(
         stdlib_json_file = stdlib_json_file,
+        sizes_json_file = sizes_json_file,
+        stdlib_export_files = stdlib_export_files,
         pkg_json_files = depset(
             direct = pkg_json_files,
             transitive = transitive_json_files,
@@ -152,6 +238,8 @@ def _go_pkg_info_aspect_impl(target, ctx):
             go_pkg_driver_srcs = pkg_info.compiled_go_files,
             go_pkg_driver_export_file = pkg_info.export_files,
             go_pkg_driver_stdlib_json_file = depset([pkg_info.stdlib_json_file] if pkg_info.stdlib_json_file else []),
+            go_pkg_driver_sizes_json_file = depset([pkg_info.sizes_json_file] if pkg_info.sizes_json_file else []),
+            go_pkg_driver_stdlib_export_file = pkg_info.stdlib_export_files,
         ),
     ]
 
@@ -44,14 +44,57 @@ type Bazel struct {
 	version               bazelVersion
 }
 
-// Minimal BEP structs to access the build outputs
-type BEPNamedSet struct {
+// Minimal BEP structs to access the build outputs and failed actions
+type BEPEvent struct {
 	NamedSetOfFiles *struct {
-		Files []struct {
-			Name string `json:"name"`
-			URI  string `json:"uri"`
-		} `json:"files"`
+		Files []BEPFile `json:"files"`
 	} `json:"namedSetOfFiles"`
+	Action *struct {
+		Success bool     `json:"success"`
+		Label   string   `json:"label"`
+		Stderr  *BEPFile `json:"stderr"`
+	} `json:"action"`
+}
+
+type BEPFile struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+}
+
+func (f BEPFile) path() (string, error) {
+	fileUrl, err := url.Parse(f.URI)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse file URI: %w", err)
+	}
+	return normalizePath(filepath.FromSlash(fileUrl.Path)), nil
+}
+
+// readLocal returns the contents of a file the BEP refers to with a file://
+// URI. Other files, such as those left in a remote cache and referred to with
+// bytestream:// URIs, and files that can't be read are skipped, since the build
+// is still usable without them.
+func (f BEPFile) readLocal() (string, bool) {
+	if !strings.HasPrefix(f.URI, "file://") {
+		return "", false
+	}
+	path, err := f.path()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", f.URI, err)
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", f.URI, err)
+		return "", false
+	}
+	return string(data), true
+}
+
+// FailedAction is an action that failed during a build, along with what it
+// wrote to stderr.
+type FailedAction struct {
+	Label  string
+	Stderr string
 }
 
 func NewBazel(ctx context.Context, bazelBin, workspaceRoot string, buildWorkingDirectory string, bazelCommonFlags []string, bazelStartupFlags []string) (*Bazel, error) {
@@ -102,10 +145,13 @@ func (b *Bazel) run(ctx context.Context, command string, args ...string) (string
 	return string(output), err
 }
 
-func (b *Bazel) Build(ctx context.Context, args ...string) ([]string, error) {
+// Build runs bazel build and returns the files it built, along with the actions
+// that failed. Bazel only reports the outputs of failed actions to the BEP by
+// default, so those are the only ones returned.
+func (b *Bazel) Build(ctx context.Context, args ...string) ([]string, []FailedAction, error) {
 	jsonFile, err := ioutil.TempFile("", "gopackagesdriver_bep_")
 	if err != nil {
-		return nil, fmt.Errorf("unable to create BEP JSON file: %w", err)
+		return nil, nil, fmt.Errorf("unable to create BEP JSON file: %w", err)
 	}
 	defer func() {
 		jsonFile.Close()
@@ -123,30 +169,37 @@ func (b *Bazel) Build(ctx context.Context, args ...string) ([]string, error) {
 		// exit codes.
 		var exerr *exec.ExitError
 		if !errors.As(err, &exerr) || exerr.ExitCode() != 1 {
-			return nil, fmt.Errorf("bazel build failed: %w", err)
+			return nil, nil, fmt.Errorf("bazel build failed: %w", err)
 		}
 	}
 
 	files := make([]string, 0)
+	var failed []FailedAction
 	decoder := json.NewDecoder(jsonFile)
 	for decoder.More() {
-		var namedSet BEPNamedSet
-		if err := decoder.Decode(&namedSet); err != nil {
-			return nil, fmt.Errorf("unable to decode %s: %w", jsonFile.Name(), err)
+		var event BEPEvent
+		if err := decoder.Decode(&event); err != nil {
+			return nil, nil, fmt.Errorf("unable to decode %s: %w", jsonFile.Name(), err)
 		}
 
-		if namedSet.NamedSetOfFiles != nil {
-			for _, f := range namedSet.NamedSetOfFiles.Files {
-				fileUrl, err := url.Parse(f.URI)
+		if event.NamedSetOfFiles != nil {
+			for _, f := range event.NamedSetOfFiles.Files {
+				path, err := f.path()
 				if err != nil {
-					return nil, fmt.Errorf("unable to parse file URI: %w", err)
+					return nil, nil, err
 				}
-				files = append(files, filepath.FromSlash(fileUrl.Path))
+				files = append(files, path)
+			}
+		}
+
+		if event.Action != nil && !event.Action.Success && event.Action.Stderr != nil {
+			if stderr, ok := event.Action.Stderr.readLocal(); ok {
+				failed = append(failed, FailedAction{Label: event.Action.Label, Stderr: stderr})
 			}
 		}
 	}
 
-	return files, nil
+	return files, failed, nil
 }
 
 func (b *Bazel) Query(ctx context.Context, args ...string) ([]string, error) {
@@ -163,6 +216,27 @@ func (b *Bazel) Query(ctx context.Context, args ...string) ([]string, error) {
 	return strings.Split(trimmedOutput, "\n"), nil
 }
 
+// QueryKeepGoing is like Query, but with --keep_going, so that it also returns
+// the results of a query that failed on some packages, along with the error.
+func (b *Bazel) QueryKeepGoing(ctx context.Context, args ...string) ([]string, error) {
+	output, err := b.run(ctx, "query", append([]string{"--keep_going"}, args...)...)
+	if err != nil {
+		// Bazel exits with 3 when the query only partially succeeded.
+		var exerr *exec.ExitError
+		if !errors.As(err, &exerr) || exerr.ExitCode() != 3 {
+			return nil, fmt.Errorf("bazel query failed: %w", err)
+		}
+		err = fmt.Errorf("bazel query partially failed: %w", err)
+	}
+
+	trimmedOutput := strings.TrimSpace(output)
+	if len(trimmedOutput) == 0 {
+		return nil, err
+	}
+
+	return strings.Split(trimmedOutput, "\n"), err
+}
+
 func (b *Bazel) WorkspaceRoot() string {
 	return b.workspaceRoot
 }
@@ -17,6 +17,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -28,21 +29,39 @@ import (
 )
 
 type BazelJSONBuilder struct {
-	bazel        *Bazel
-	includeTests bool
+	bazel         *Bazel
+	includeTests  bool
+	variant       string
+	tags          []string
+	sizesJSONFile string
+}
+
+// variantSettings maps the build variants the driver can report to the
+// rules_go build settings enabling them. Each variant is also the build tag
+// the go command sets for it.
+var variantSettings = map[string]string{
+	"race": "//go/config:race",
+	"msan": "//go/config:msan",
+}
+
+// Sizes are the arguments of types.SizesFor for the platform the packages are
+// built for.
+type Sizes struct {
+	Compiler string
+	Arch     string
 }
 
 var RulesGoStdlibLabel = rulesGoRepositoryName + "//:stdlib"
 
 var _defaultKinds = []string{"go_library", "go_test", "go_binary"}
 
-var externalRe = regexp.MustCompile(".*\\/external\\/([^\\/]+)(\\/(.*))?\\/([^\\/]+.go)")
+var externalRe = regexp.MustCompile(".*\\/external\\/([^\\/]+)(\\/(.*))?\\/([^\\/]+)$")
 
 func (b *BazelJSONBuilder) fileQuery(label string) string {
 	label = b.adjustToRelativePathIfPossible(label)
 	filename := filepath.FromSlash(label)
 
-	if matches := externalRe.FindStringSubmatch(filename); len(matches) == 5 {
+	if matches := externalRe.FindStringSubmatch(filepath.ToSlash(filename)); len(matches) == 5 {
 		// if filepath is for a third party lib, we need to know, what external
 		// library this file is part of.
 		matches = append(matches[:2], matches[3:]...)
@@ -87,11 +106,7 @@ func (b *BazelJSONBuilder) getKind() string {
 }
 
 func (b *BazelJSONBuilder) localQuery(request string) string {
-	request = b.adjustToRelativePathIfPossible(request)
-
-	if !strings.HasSuffix(request, "...") {
-		request = fmt.Sprintf("%s:*", request)
-	}
+	request = targetPatternFromPath(b.adjustToRelativePathIfPossible(request))
 
 	return fmt.Sprintf(`kind("^(%s) rule$", %s)`, b.getKind(), request)
 }
@@ -124,18 +139,54 @@ func (b *BazelJSONBuilder) packageQuery(importPath string) string {
 		bazelQueryScope)
 }
 
+// workspaceImportPathQuery returns the query for the workspace packages with
+// the dotless import paths among requests, or "" if there are none. Those are
+// otherwise only looked up in the standard library when there is no query
+// scope. Unlike packageQuery, the import paths are matched exactly.
+func (b *BazelJSONBuilder) workspaceImportPathQuery(requests []string) string {
+	if bazelQueryScope != "" {
+		return ""
+	}
+	var queries []string
+	for _, request := range requests {
+		if !isStdlibImportPath(request) {
+			continue
+		}
+		pattern := fmt.Sprintf(`^%s$`, regexp.QuoteMeta(request))
+		if strings.HasSuffix(request, "/...") {
+			pattern = fmt.Sprintf(`^%s(/.+)?$`, regexp.QuoteMeta(strings.TrimSuffix(request, "/...")))
+		}
+		queries = append(queries, fmt.Sprintf(`kind("^(%s) rule$", attr(importpath, "%s", //...))`, b.getKind(), pattern))
+	}
+	return strings.Join(queries, " union ")
+}
+
 func (b *BazelJSONBuilder) queryFromRequests(requests ...string) string {
+	if len(requests) == 0 && bazelDefaultQuery != "" {
+		return fmt.Sprintf(`kind("^(%s) rule$", %s)`, b.getKind(), bazelDefaultQuery)
+	}
+
 	ret := make([]string, 0, len(requests))
 	for _, request := range requests {
 		result := ""
-		if strings.HasSuffix(request, ".go") {
+		// Any file may be queried with file=, not only Go sources: editors
+		// also ask for the package owning assembly files or headers.
+		if strings.HasPrefix(request, "file=") || strings.HasSuffix(request, ".go") {
 			f := strings.TrimPrefix(request, "file=")
 			result = b.fileQuery(f)
+		} else if isTargetPattern(request) {
+			result = fmt.Sprintf(`kind("^(%s) rule$", %s)`, b.getKind(), request)
+		} else if request == "builtin" {
+			// The builtin package is part of the stdlib JSON file.
+			result = RulesGoStdlibLabel
 		} else if bazelQueryScope != "" {
 			result = b.packageQuery(request)
+			if isStdlibImportPath(request) {
+				result = fmt.Sprintf("%s union %s", result, RulesGoStdlibLabel)
+			}
 		} else if isLocalPattern(request) {
 			result = b.localQuery(request)
-		} else if request == "builtin" || request == "std" {
+		} else if request == "std" || isStdlibImportPath(request) {
 			result = fmt.Sprintf(RulesGoStdlibLabel)
 		}
 
@@ -149,27 +200,94 @@ func (b *BazelJSONBuilder) queryFromRequests(requests ...string) string {
 	return strings.Join(ret, " union ")
 }
 
-func NewBazelJSONBuilder(bazel *Bazel, includeTests bool) (*BazelJSONBuilder, error) {
+// HandledRequests returns the requests Bazel can answer, leaving out files
+// outside of the workspace and of the output base, such as those in the
+// module cache.
+func (b *BazelJSONBuilder) HandledRequests(requests []string) []string {
+	handled := make([]string, 0, len(requests))
+	for _, request := range requests {
+		if strings.HasPrefix(request, "file=") || strings.HasSuffix(request, ".go") {
+			f := filepath.FromSlash(strings.TrimPrefix(request, "file="))
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(b.bazel.BuildWorkingDirectory(), f)
+			}
+			if !isInDir(f, b.bazel.WorkspaceRoot()) && !isInDir(f, b.bazel.OutputBase()) {
+				fmt.Fprintf(os.Stderr, "Not handling %s outside of the workspace\n", f)
+				continue
+			}
+		}
+		handled = append(handled, request)
+	}
+	return handled
+}
+
+// StdlibRoots returns the standard library import paths named by requests.
+// A nil result means every standard library package is a root, which is the
+// case for the "std" query and for requests that don't match anything else.
+func (b *BazelJSONBuilder) StdlibRoots(requests []string) []string {
+	var roots []string
+	for _, request := range requests {
+		if request == "std" {
+			return nil
+		}
+		if request == "builtin" || isStdlibImportPath(request) {
+			roots = append(roots, request)
+		}
+	}
+	return roots
+}
+
+// NewBazelJSONBuilder returns a builder for the packages of bazel. If variant
+// isn't empty, the packages are built with the matching instrumentation, and
+// if tags isn't, with those build tags.
+func NewBazelJSONBuilder(bazel *Bazel, includeTests bool, variant string, tags []string) (*BazelJSONBuilder, error) {
+	if _, ok := variantSettings[variant]; variant != "" && !ok {
+		return nil, fmt.Errorf("unknown variant %q, expected race or msan", variant)
+	}
 	return &BazelJSONBuilder{
 		bazel:        bazel,
 		includeTests: includeTests,
+		variant:      variant,
+		tags:         tags,
 	}, nil
 }
 
+// buildSettingFlags returns the bazel flags selecting the variant and build
+// tags of the builder.
+func (b *BazelJSONBuilder) buildSettingFlags() []string {
+	var flags []string
+	if b.variant != "" {
+		flags = append(flags, "--"+rulesGoRepositoryName+variantSettings[b.variant])
+	}
+	if len(b.tags) > 0 {
+		flags = append(flags, "--"+rulesGoRepositoryName+"//go/config:tags="+strings.Join(b.tags, ","))
+	}
+	return flags
+}
+
 func (b *BazelJSONBuilder) outputGroupsForMode(mode LoadMode) string {
-	og := "go_pkg_driver_json_file,go_pkg_driver_stdlib_json_file,go_pkg_driver_srcs"
-	if mode&NeedExportsFile != 0 {
-		og += ",go_pkg_driver_export_file"
+	og := "go_pkg_driver_json_file,go_pkg_driver_stdlib_json_file,go_pkg_driver_sizes_json_file,go_pkg_driver_srcs"
+	if mode.needsExportFile() {
+		og += ",go_pkg_driver_export_file,go_pkg_driver_stdlib_export_file"
 	}
 	return og
 }
 
 func (b *BazelJSONBuilder) query(ctx context.Context, query string) ([]string, error) {
+	labels, err := b.bazel.Query(ctx, b.queryArgs(query)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return labels, nil
+}
+
+func (b *BazelJSONBuilder) queryArgs(query string) []string {
 	var bzlmodQueryFlags []string
 	if b.bazel.version.isAtLeast(bazelVersion{6, 4, 0}) {
 		bzlmodQueryFlags = []string{"--consistent_labels"}
 	}
-	queryArgs := concatStringsArrays(bazelQueryFlags, bzlmodQueryFlags, []string{
+	return concatStringsArrays(bazelQueryFlags, bzlmodQueryFlags, []string{
 		"--ui_event_filters=-info,-stderr",
 		"--noshow_progress",
 		"--order_output=no",
@@ -179,12 +297,6 @@ func (b *BazelJSONBuilder) query(ctx context.Context, query string) ([]string, e
 		"--notool_deps",
 		query,
 	})
-	labels, err := b.bazel.Query(ctx, queryArgs...)
-	if err != nil {
-		return nil, fmt.Errorf("unable to query: %w", err)
-	}
-
-	return labels, nil
 }
 
 func (b *BazelJSONBuilder) Labels(ctx context.Context, requests []string) ([]string, error) {
@@ -193,6 +305,18 @@ func (b *BazelJSONBuilder) Labels(ctx context.Context, requests []string) ([]str
 		return nil, fmt.Errorf("query failed: %w", err)
 	}
 
+	// Workspace packages may have dotless import paths too, such as
+	// "mycompany/foo". Looking for them in the whole workspace is slow and
+	// fails on any broken BUILD file, so it is only done on a best-effort
+	// basis, without holding up the standard library lookup.
+	if query := b.workspaceImportPathQuery(requests); query != "" {
+		workspaceLabels, err := b.bazel.QueryKeepGoing(ctx, b.queryArgs(query)...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping the workspace lookup of %v: %v\n", requests, err)
+		}
+		labels = append(labels, workspaceLabels...)
+	}
+
 	if len(labels) == 0 {
 		return nil, fmt.Errorf("found no labels matching the requests")
 	}
@@ -200,7 +324,10 @@ func (b *BazelJSONBuilder) Labels(ctx context.Context, requests []string) ([]str
 	return labels, nil
 }
 
-func (b *BazelJSONBuilder) Build(ctx context.Context, labels []string, mode LoadMode) ([]string, error) {
+// Build runs the aspect on labels and returns the package JSON files it wrote,
+// along with the actions that failed, such as the compilation of packages with
+// errors.
+func (b *BazelJSONBuilder) Build(ctx context.Context, labels []string, mode LoadMode) ([]string, []FailedAction, error) {
 	aspects := append(additionalAspects, goDefaultAspect)
 
 	buildArgs := concatStringsArrays([]string{
@@ -210,7 +337,7 @@ func (b *BazelJSONBuilder) Build(ctx context.Context, labels []string, mode Load
 		"--aspects=" + strings.Join(aspects, ","),
 		"--output_groups=" + b.outputGroupsForMode(mode),
 		"--keep_going", // Build all possible packages
-	}, bazelBuildFlags)
+	}, b.buildSettingFlags(), bazelBuildFlags)
 
 	if len(labels) < 100 {
 		buildArgs = append(buildArgs, labels...)
@@ -218,7 +345,7 @@ func (b *BazelJSONBuilder) Build(ctx context.Context, labels []string, mode Load
 		// To avoid hitting MAX_ARGS length, write labels to a file and use `--target_pattern_file`
 		targetsFile, err := ioutil.TempFile("", "gopackagesdriver_targets_")
 		if err != nil {
-			return nil, fmt.Errorf("unable to create target pattern file: %w", err)
+			return nil, nil, fmt.Errorf("unable to create target pattern file: %w", err)
 		}
 		writer := bufio.NewWriter(targetsFile)
 		defer writer.Flush()
@@ -226,7 +353,7 @@ func (b *BazelJSONBuilder) Build(ctx context.Context, labels []string, mode Load
 			writer.WriteString(l + "\n")
 		}
 		if err := writer.Flush(); err != nil {
-			return nil, fmt.Errorf("unable to flush data to target pattern file: %w", err)
+			return nil, nil, fmt.Errorf("unable to flush data to target pattern file: %w", err)
 		}
 		defer func() {
 			targetsFile.Close()
@@ -235,19 +362,38 @@ func (b *BazelJSONBuilder) Build(ctx context.Context, labels []string, mode Load
 
 		buildArgs = append(buildArgs, "--target_pattern_file="+targetsFile.Name())
 	}
-	files, err := b.bazel.Build(ctx, buildArgs...)
+	files, failed, err := b.bazel.Build(ctx, buildArgs...)
 	if err != nil {
-		return nil, fmt.Errorf("unable to bazel build %v: %w", buildArgs, err)
+		return nil, nil, fmt.Errorf("unable to bazel build %v: %w", buildArgs, err)
 	}
 
 	ret := []string{}
 	for _, f := range files {
 		if strings.HasSuffix(f, ".pkg.json") {
-			ret = append(ret, cleanPath(f))
+			ret = append(ret, f)
+		} else if strings.HasSuffix(f, ".sizes.json") && b.sizesJSONFile == "" {
+			b.sizesJSONFile = f
 		}
 	}
 
-	return ret, nil
+	return ret, failed, nil
+}
+
+// Sizes returns the sizes of the platform the last Build was configured for,
+// or those of the host if it didn't report any.
+func (b *BazelJSONBuilder) Sizes() (*Sizes, error) {
+	sizes := &Sizes{Compiler: "gc", Arch: runtime.GOARCH}
+	if b.sizesJSONFile == "" {
+		return sizes, nil
+	}
+	data, err := os.ReadFile(b.sizesJSONFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sizes: %w", err)
+	}
+	if err := json.Unmarshal(data, sizes); err != nil {
+		return nil, fmt.Errorf("unable to decode sizes: %w", err)
+	}
+	return sizes, nil
 }
 
 func (b *BazelJSONBuilder) PathResolver() PathResolverFunc {
@@ -255,15 +401,6 @@ func (b *BazelJSONBuilder) PathResolver() PathResolverFunc {
 		p = strings.Replace(p, "__BAZEL_EXECROOT__", b.bazel.ExecutionRoot(), 1)
 		p = strings.Replace(p, "__BAZEL_WORKSPACE__", b.bazel.WorkspaceRoot(), 1)
 		p = strings.Replace(p, "__BAZEL_OUTPUT_BASE__", b.bazel.OutputBase(), 1)
-		return p
+		return normalizePath(p)
 	}
 }
-
-func cleanPath(p string) string {
-	// On Windows the paths may contain a starting `\`, this would make them not resolve
-	if runtime.GOOS == "windows" && p[0] == '\\' {
-		return p[1:]
-	}
-
-	return p
-}
@@ -2,33 +2,112 @@ package main
 
 import (
 	"go/build"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
-var buildContext = makeBuildContext()
+var buildContext = makeBuildContext("", nil)
 
-func makeBuildContext() *build.Context {
+// makeBuildContext returns the build context of the packages, which also
+// matches the tag of the build variant if there is one, and tags.
+func makeBuildContext(variant string, tags []string) *build.Context {
 	bctx := build.Default
 	bctx.BuildTags = strings.Split(getenvDefault("GOTAGS", ""), ",")
+	if variant != "" {
+		bctx.BuildTags = append(bctx.BuildTags, variant)
+	}
+	bctx.BuildTags = append(bctx.BuildTags, tags...)
+
+	return &bctx
+}
 
+// buildContextWithTags returns buildContext with the additional build tags of
+// a package.
+func buildContextWithTags(tags []string) *build.Context {
+	if len(tags) == 0 {
+		return buildContext
+	}
+	bctx := *buildContext
+	bctx.BuildTags = append(append([]string(nil), buildContext.BuildTags...), tags...)
 	return &bctx
 }
 
-func filterSourceFilesForTags(files []string) []string {
-	ret := make([]string, 0, len(files))
+// requestBuildTags returns the build tags set by the -tags flag in the build
+// flags of request or, without one, in the GOFLAGS of its environment. This is
+// how clients such as gopls pass their configured build flags.
+func requestBuildTags(request *DriverRequest) []string {
+	if tags, ok := tagsFromFlags(request.BuildFlags); ok {
+		return tags
+	}
+	goflags := os.Getenv("GOFLAGS")
+	for _, env := range request.Env {
+		if v, ok := strings.CutPrefix(env, "GOFLAGS="); ok {
+			goflags = v
+		}
+	}
+	tags, _ := tagsFromFlags(strings.Fields(goflags))
+	return tags
+}
+
+// tagsFromFlags returns the tags of the last -tags flag in flags, which like
+// the go command accepts a comma or space separated list.
+func tagsFromFlags(flags []string) ([]string, bool) {
+	var value string
+	found := false
+	for i := 0; i < len(flags); i++ {
+		if !strings.HasPrefix(flags[i], "-") {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(flags[i], "-"), "-")
+		if v, ok := strings.CutPrefix(name, "tags="); ok {
+			value, found = v, true
+		} else if name == "tags" && i+1 < len(flags) {
+			value, found = flags[i+1], true
+			i++
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }), true
+}
+
+func filterSourceFilesForTags(bctx *build.Context, files []string) []string {
+	ret, _ := partitionSourceFilesForTags(bctx, files)
+	return ret
+}
+
+// buildConstrainedExts are the extensions of the files go/build applies build
+// constraints to. Others, such as the .inc files included by assembly, are
+// kept whatever their name.
+var buildConstrainedExts = map[string]struct{}{
+	".go": {}, ".c": {}, ".cc": {}, ".cpp": {}, ".cxx": {}, ".m": {},
+	".h": {}, ".hh": {}, ".hpp": {}, ".hxx": {}, ".f": {}, ".F": {},
+	".for": {}, ".f90": {}, ".s": {}, ".S": {}, ".sx": {}, ".swig": {},
+	".swigcxx": {}, ".syso": {},
+}
+
+// partitionSourceFilesForTags splits files into those matching the build
+// constraints of bctx and those that don't.
+func partitionSourceFilesForTags(bctx *build.Context, files []string) (matched, ignored []string) {
+	matched = make([]string, 0, len(files))
 
 	for _, f := range files {
 		dir, filename := filepath.Split(f)
 		ext := filepath.Ext(f)
 
-		match, _ := buildContext.MatchFile(dir, filename)
+		match, _ := bctx.MatchFile(dir, filename)
 		// MatchFile filters out anything without a file extension. In the
 		// case of CompiledGoFiles (in particular gco processed files from
-		// the cache), we want them.
-		if match || ext == "" {
-			ret = append(ret, f)
+		// the cache), we want them. It also rejects the extensions it doesn't
+		// know.
+		_, constrained := buildConstrainedExts[ext]
+		if match || ext == "" || !constrained {
+			matched = append(matched, f)
+		} else {
+			ignored = append(ignored, f)
 		}
 	}
-	return ret
+	return matched, ignored
 }
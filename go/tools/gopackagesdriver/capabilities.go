@@ -0,0 +1,96 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// capabilitiesFlag prints the capabilities of the driver instead of answering
+// a request.
+const capabilitiesFlag = "--capabilities"
+
+// driverProtocolVersion is the version of the response format. It's bumped
+// when a change would break clients relying on earlier behavior.
+const driverProtocolVersion = 1
+
+// Features the driver supports, as listed in driverCapabilities.
+const (
+	// featureOverlay: overlays from the request are applied, including new
+	// files that don't exist on disk.
+	featureOverlay = "overlay"
+	// featureStdlib: standard library packages are reported with their
+	// sources and export data.
+	featureStdlib = "stdlib"
+	// featureTests: test packages and external test packages are reported
+	// when the request sets Tests.
+	featureTests = "tests"
+	// featureLoadMode: fields not needed for the requested mode are dropped.
+	featureLoadMode = "load-mode"
+	// featureModule: packages report the module they belong to.
+	featureModule = "module"
+	// featureEmbed: packages report EmbedPatterns and EmbedFiles.
+	featureEmbed = "embed"
+	// featureBuildErrors: compile errors are reported in package Errors.
+	featureBuildErrors = "build-errors"
+	// featureGeneratedFiles: packages report the rules generating their
+	// generated sources.
+	featureGeneratedFiles = "generated-files"
+	// featureTargetPatterns: Bazel target patterns are accepted as patterns.
+	featureTargetPatterns = "target-patterns"
+)
+
+// driverCapabilities describes what the driver supports, so that clients can
+// adapt to older drivers instead of misbehaving. It's part of every response,
+// where go/packages ignores it, and printed by capabilitiesFlag.
+type driverCapabilities struct {
+	Version  int
+	Features []string
+	// Variants are the values accepted by variantFlag.
+	Variants []string
+}
+
+func currentCapabilities() *driverCapabilities {
+	variants := keysFromMap(variantSettings)
+	sort.Strings(variants)
+	return &driverCapabilities{
+		Version: driverProtocolVersion,
+		Features: []string{
+			featureOverlay,
+			featureStdlib,
+			featureTests,
+			featureLoadMode,
+			featureModule,
+			featureEmbed,
+			featureBuildErrors,
+			featureGeneratedFiles,
+			featureTargetPatterns,
+		},
+		Variants: variants,
+	}
+}
+
+// writeCapabilities writes the capabilities of the driver as JSON to out.
+func writeCapabilities(out io.Writer) error {
+	data, err := json.Marshal(currentCapabilities())
+	if err != nil {
+		return fmt.Errorf("unable to marshal capabilities: %w", err)
+	}
+	_, err = out.Write(data)
+	return err
+}
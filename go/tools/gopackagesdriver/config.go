@@ -0,0 +1,114 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFileName is the name of the optional configuration file in the
+// workspace root.
+const configFileName = ".gopackagesdriver.json"
+
+// driverConfig is the contents of the configuration file. Each setting is
+// overridden by the environment variable noted next to it, so that a single
+// invocation can deviate from what's checked in.
+type driverConfig struct {
+	// Bazel is the bazel binary to run. GOPACKAGESDRIVER_BAZEL
+	Bazel string `json:"bazel"`
+	// StartupFlags go before the bazel command. GOPACKAGESDRIVER_BAZEL_FLAGS
+	StartupFlags []string `json:"startup_flags"`
+	// CommonFlags are passed to every bazel command.
+	// GOPACKAGESDRIVER_BAZEL_COMMON_FLAGS
+	CommonFlags []string `json:"common_flags"`
+	// Configs are passed to every bazel command as --config values, after
+	// CommonFlags.
+	Configs []string `json:"configs"`
+	// QueryFlags are passed to bazel query. GOPACKAGESDRIVER_BAZEL_QUERY_FLAGS
+	QueryFlags []string `json:"query_flags"`
+	// QueryScope limits import path queries to the dependencies of a target
+	// pattern. GOPACKAGESDRIVER_BAZEL_QUERY_SCOPE
+	QueryScope string `json:"query_scope"`
+	// BuildFlags are passed to bazel build. GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS
+	BuildFlags []string `json:"build_flags"`
+	// Targets are the Bazel target patterns loaded when go/packages sends no
+	// patterns. GOPACKAGESDRIVER_BAZEL_QUERY
+	Targets []string `json:"targets"`
+	// Paths selects how file paths are reported. GOPACKAGESDRIVER_PATHS
+	Paths string `json:"paths"`
+}
+
+// loadConfig reads the configuration file in dir. A missing file is an empty
+// configuration.
+func loadConfig(dir string) (*driverConfig, error) {
+	cfg := &driverConfig{}
+	data, err := os.ReadFile(filepath.Join(dir, configFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", configFileName, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", configFileName, err)
+	}
+	return cfg, nil
+}
+
+// apply sets the settings of cfg that aren't overridden by the environment.
+func (cfg *driverConfig) apply() {
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL"); !ok && cfg.Bazel != "" {
+		bazelBin = cfg.Bazel
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL_FLAGS"); !ok {
+		bazelStartupFlags = append(bazelStartupFlags, cfg.StartupFlags...)
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL_COMMON_FLAGS"); !ok {
+		bazelCommonFlags = append(bazelCommonFlags, cfg.CommonFlags...)
+	}
+	for _, config := range cfg.Configs {
+		bazelCommonFlags = append(bazelCommonFlags, "--config="+config)
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL_QUERY_FLAGS"); !ok {
+		bazelQueryFlags = append(bazelQueryFlags, cfg.QueryFlags...)
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL_QUERY_SCOPE"); !ok && cfg.QueryScope != "" {
+		bazelQueryScope = cfg.QueryScope
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS"); !ok {
+		bazelBuildFlags = append(bazelBuildFlags, cfg.BuildFlags...)
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_BAZEL_QUERY"); !ok && len(cfg.Targets) > 0 {
+		bazelDefaultQuery = strings.Join(cfg.Targets, " union ")
+	}
+	if _, ok := os.LookupEnv("GOPACKAGESDRIVER_PATHS"); !ok && cfg.Paths != "" {
+		bazelPathMode = cfg.Paths
+	}
+}
+
+// configDir returns the directory the configuration file is looked up in:
+// the workspace root when running under bazel run, and otherwise the working
+// directory, which bazel also runs in.
+func configDir() string {
+	if workspaceRoot != "" {
+		return workspaceRoot
+	}
+	wd, _ := os.Getwd()
+	return wd
+}
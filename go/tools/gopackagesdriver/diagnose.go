@@ -0,0 +1,184 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diagnoseCommand checks that the driver works in the current workspace
+// instead of answering a request. It takes an optional target pattern of the
+// package to load, and otherwise picks a go_library below the working
+// directory.
+const diagnoseCommand = "diagnose"
+
+// minimumBazelVersion is the oldest version of Bazel rules_go supports. Keep
+// in sync with MINIMUM_BAZEL_VERSION in go/private/common.bzl.
+var minimumBazelVersion = bazelVersion{6, 5, 0}
+
+// diagnosis reports the outcome of the checks of diagnose.
+type diagnosis struct {
+	out    io.Writer
+	failed bool
+}
+
+func (d *diagnosis) ok(check, format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "ok    %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// fail reports a failed check along with what to do about it.
+func (d *diagnosis) fail(check string, err error, hint string) {
+	d.failed = true
+	fmt.Fprintf(d.out, "FAIL  %s: %v\n", check, err)
+	for _, line := range strings.Split(hint, "\n") {
+		fmt.Fprintf(d.out, "      %s\n", line)
+	}
+}
+
+// diagnose checks the setup of the driver end to end and writes what it finds
+// to out. It returns an error if any check failed.
+func diagnose(ctx context.Context, out io.Writer, args []string) error {
+	d := &diagnosis{out: out}
+	d.run(ctx, args)
+	if d.failed {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+func (d *diagnosis) run(ctx context.Context, args []string) {
+	bazel, err := NewBazel(ctx, bazelBin, workspaceRoot, buildWorkingDirectory, bazelCommonFlags, bazelStartupFlags)
+	if err != nil {
+		d.fail("bazel", err, fmt.Sprintf("Unable to run %q. Set GOPACKAGESDRIVER_BAZEL to the bazel binary, and run\nthe driver from inside the workspace.", bazelBin))
+		return
+	}
+	d.ok("bazel", "%s in %s", bazel.info["release"], bazel.WorkspaceRoot())
+
+	if !bazel.version.isAtLeast(minimumBazelVersion) {
+		d.fail("bazel version", fmt.Errorf("%s is too old", bazel.info["release"]), fmt.Sprintf("rules_go requires Bazel %d.%d.%d or newer.", minimumBazelVersion[0], minimumBazelVersion[1], minimumBazelVersion[2]))
+	} else {
+		d.ok("bazel version", "at least %d.%d.%d", minimumBazelVersion[0], minimumBazelVersion[1], minimumBazelVersion[2])
+	}
+
+	aspectsOK := true
+	for _, aspect := range append([]string{goDefaultAspect}, additionalAspects...) {
+		file, _, _ := strings.Cut(aspect, "%")
+		if _, err := bazel.Query(ctx, file); err != nil {
+			aspectsOK = false
+			d.fail("aspect", fmt.Errorf("unable to find %s", file), "The driver was built for rules_go as "+repoNameOrMain(rulesGoRepositoryName)+". Make sure the workspace\ndepends on rules_go under that name, and that GOPACKAGESDRIVER_BAZEL_ADDTL_ASPECTS\nonly lists existing aspects.")
+			continue
+		}
+		d.ok("aspect", "%s", aspect)
+	}
+	if !aspectsOK {
+		return
+	}
+
+	target, err := sampleTarget(ctx, bazel, args)
+	if err != nil {
+		d.fail("sample package", err, "Pass the target pattern of a Go package to load: gopackagesdriver diagnose //some:target")
+		return
+	}
+
+	builder, err := NewBazelJSONBuilder(bazel, false, bazelVariant, nil)
+	if err != nil {
+		d.fail("build", err, "Check GOPACKAGESDRIVER_VARIANT.")
+		return
+	}
+	jsonFiles, _, err := builder.Build(ctx, []string{target}, 0)
+	if err != nil {
+		d.fail("build", err, "Bazel couldn't run the aspect, see its output above. Check\nGOPACKAGESDRIVER_BAZEL_BUILD_FLAGS and the configuration file.")
+		return
+	}
+	if len(jsonFiles) == 0 {
+		d.fail("build", fmt.Errorf("the aspect wrote no package for %s", target), "Make sure the target is a go_library, go_binary or go_test.")
+		return
+	}
+	d.ok("build", "%d packages for %s", len(jsonFiles), target)
+	if builder.sizesJSONFile == "" {
+		d.fail("rules_go version", errors.New("the aspect doesn't report the target platform"), "The rules_go version of the workspace is older than the driver. Run the\ndriver from the same rules_go version, such as with\nbazel run "+rulesGoRepositoryName+"//go/tools/gopackagesdriver.")
+	} else {
+		d.ok("rules_go version", "the aspect matches the driver")
+	}
+
+	resp, err := loadSample(ctx, target)
+	if err != nil {
+		d.fail("load", err, "Please report this along with the output above.")
+		return
+	}
+	if len(resp.Roots) == 0 {
+		d.fail("load", fmt.Errorf("no package matched %s", target), "Please report this along with the output above.")
+		return
+	}
+	for _, pkg := range resp.Packages {
+		if contains(resp.Roots, pkg.ID) && len(pkg.Errors) > 0 {
+			d.fail("load", fmt.Errorf("%s has errors: %v", pkg.ID, pkg.Errors[0]), "The driver works, but the package doesn't compile.")
+			return
+		}
+	}
+	d.ok("load", "%d packages in the response for %s", len(resp.Packages), target)
+}
+
+// sampleTarget returns the target to load: the one in args, or the first
+// go_library below the working directory.
+func sampleTarget(ctx context.Context, bazel *Bazel, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	builder, err := NewBazelJSONBuilder(bazel, false, "", nil)
+	if err != nil {
+		return "", err
+	}
+	pattern := targetPatternFromPath(builder.adjustToRelativePathIfPossible("./..."))
+	labels, err := bazel.Query(ctx, fmt.Sprintf(`kind("^go_library rule$", %s)`, pattern))
+	if err != nil {
+		return "", err
+	}
+	if len(labels) == 0 {
+		return "", fmt.Errorf("no go_library in %s", pattern)
+	}
+	return labels[0], nil
+}
+
+// loadSample answers a request for target the way go/packages would send it.
+func loadSample(ctx context.Context, target string) (*driverResponse, error) {
+	request, err := json.Marshal(DriverRequest{Mode: NeedName | NeedFiles | NeedCompiledGoFiles | NeedImports | NeedDeps | NeedExportFile | NeedTypes | NeedTypesSizes})
+	if err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	if err := runWithState(ctx, nil, bytes.NewReader(request), out, []string{target}); err != nil {
+		return nil, err
+	}
+	resp := &driverResponse{}
+	if err := json.Unmarshal(out.Bytes(), resp); err != nil {
+		return nil, fmt.Errorf("unable to decode response: %w", err)
+	}
+	return resp, nil
+}
+
+// repoNameOrMain describes the repository name for humans.
+func repoNameOrMain(name string) string {
+	if name == "" || name == "@" {
+		return "the main repository"
+	}
+	return name
+}
@@ -28,7 +28,7 @@ const (
 	// NeedName adds Name and PkgPath.
 	NeedName LoadMode = 1 << iota
 
-	// NeedFiles adds GoFiles and OtherFiles.
+	// NeedFiles adds GoFiles, OtherFiles and IgnoredFiles.
 	NeedFiles
 
 	// NeedCompiledGoFiles adds CompiledGoFiles.
@@ -62,19 +62,47 @@ const (
 
 	// NeedModule adds Module.
 	NeedModule
+
+	// NeedEmbedFiles adds EmbedFiles.
+	NeedEmbedFiles
+
+	// NeedEmbedPatterns adds EmbedPatterns.
+	NeedEmbedPatterns
 )
 
 // Deprecated: NeedExportsFile is a historical misspelling of NeedExportFile.
 const NeedExportsFile = NeedExportFile
 
+// implied returns mode with the bits go/packages implicitly adds to it, see
+// impliedLoadMode in golang.org/x/tools/go/packages.
+func (mode LoadMode) implied() LoadMode {
+	if mode&(NeedDeps|NeedTypes|NeedTypesInfo) != 0 {
+		// All these things require knowing the import graph.
+		mode |= NeedImports
+	}
+	return mode
+}
+
+// needsExportFile reports whether go/packages will read export data when
+// loading with mode, see usesExportData in golang.org/x/tools/go/packages.
+func (mode LoadMode) needsExportFile() bool {
+	return mode&NeedExportFile != 0 || mode&NeedTypes != 0 && mode&NeedDeps == 0
+}
+
+// needsCompiledGoFiles reports whether go/packages will parse the compiled
+// sources when loading with mode.
+func (mode LoadMode) needsCompiledGoFiles() bool {
+	return mode&(NeedCompiledGoFiles|NeedSyntax|NeedTypes|NeedTypesInfo) != 0
+}
+
 // From https://github.com/golang/tools/blob/v0.1.0/go/packages/external.go#L32
 // Most fields are disabled since there is no need for them
 type DriverRequest struct {
 	Mode LoadMode `json:"mode"`
 	// Env specifies the environment the underlying build system should be run in.
-	// Env []string `json:"env"`
+	Env []string `json:"env"`
 	// BuildFlags are flags that should be passed to the underlying build system.
-	// BuildFlags []string `json:"build_flags"`
+	BuildFlags []string `json:"build_flags"`
 	// Tests specifies whether the patterns should also return test packages.
 	Tests bool `json:"tests"`
 	// Overlay maps file paths (relative to the driver's working directory) to the byte contents
@@ -87,5 +115,6 @@ func ReadDriverRequest(r io.Reader) (*DriverRequest, error) {
 	if err := json.NewDecoder(r).Decode(&req); err != nil {
 		return nil, fmt.Errorf("unable to decode driver request: %w", err)
 	}
+	req.Overlay = normalizeOverlay(req.Overlay)
 	return req, nil
 }
@@ -18,12 +18,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"go/ast"
 	"go/parser"
 	"go/token"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 type ResolvePkgFunc func(importPath string) string
@@ -62,9 +65,27 @@ type FlatPackage struct {
 	GoFiles         []string            `json:",omitempty"`
 	CompiledGoFiles []string            `json:",omitempty"`
 	OtherFiles      []string            `json:",omitempty"`
+	IgnoredFiles    []string            `json:",omitempty"`
 	ExportFile      string              `json:",omitempty"`
 	Imports         map[string]string   `json:",omitempty"`
 	Standard        bool                `json:",omitempty"`
+	ForTest         string              `json:",omitempty"`
+	Module          *FlatPackageModule  `json:",omitempty"`
+	EmbedPatterns   []string            `json:",omitempty"`
+	EmbedFiles      []string            `json:",omitempty"`
+
+	// GeneratedFiles maps the generated sources of the package to the labels
+	// of the rules generating them. It isn't part of go/packages, which
+	// ignores it, but lets editors tell where generated code comes from.
+	GeneratedFiles map[string]string `json:",omitempty"`
+
+	// BuildTags are the build tags the package was compiled with, as set by
+	// the gotags build setting or implied by the build mode, such as race.
+	// Like GeneratedFiles, it isn't part of go/packages.
+	BuildTags []string `json:",omitempty"`
+
+	// cgoGoFiles are the Go files generated by cgo for this package.
+	cgoGoFiles []string
 }
 
 type (
@@ -97,30 +118,195 @@ func WalkFlatPackagesFromJSON(jsonFile string, onPkg PackageFunc) error {
 	return nil
 }
 
+// clone returns a deep copy of fp.
+func (fp *FlatPackage) clone() *FlatPackage {
+	c := *fp
+	c.Errors = append([]FlatPackagesError(nil), fp.Errors...)
+	c.GoFiles = append([]string(nil), fp.GoFiles...)
+	c.CompiledGoFiles = append([]string(nil), fp.CompiledGoFiles...)
+	c.OtherFiles = append([]string(nil), fp.OtherFiles...)
+	c.IgnoredFiles = append([]string(nil), fp.IgnoredFiles...)
+	c.EmbedPatterns = append([]string(nil), fp.EmbedPatterns...)
+	c.EmbedFiles = append([]string(nil), fp.EmbedFiles...)
+	c.BuildTags = append([]string(nil), fp.BuildTags...)
+	c.cgoGoFiles = append([]string(nil), fp.cgoGoFiles...)
+	if fp.Imports != nil {
+		c.Imports = make(map[string]string, len(fp.Imports))
+		for k, v := range fp.Imports {
+			c.Imports[k] = v
+		}
+	}
+	if fp.GeneratedFiles != nil {
+		c.GeneratedFiles = make(map[string]string, len(fp.GeneratedFiles))
+		for k, v := range fp.GeneratedFiles {
+			c.GeneratedFiles[k] = v
+		}
+	}
+	return &c
+}
+
 func (fp *FlatPackage) ResolvePaths(prf PathResolverFunc) error {
 	resolvePathsInPlace(prf, fp.CompiledGoFiles)
 	resolvePathsInPlace(prf, fp.GoFiles)
 	resolvePathsInPlace(prf, fp.OtherFiles)
+	resolvePathsInPlace(prf, fp.IgnoredFiles)
+	resolvePathsInPlace(prf, fp.EmbedFiles)
 	fp.ExportFile = prf(fp.ExportFile)
+	fp.expandCgoGoFiles()
+	if len(fp.GeneratedFiles) > 0 {
+		generatedFiles := make(map[string]string, len(fp.GeneratedFiles))
+		for f, label := range fp.GeneratedFiles {
+			generatedFiles[prf(f)] = label
+		}
+		fp.GeneratedFiles = generatedFiles
+	}
 	return nil
 }
 
-// FilterFilesForBuildTags filters the source files given the current build
-// tags.
+// RewritePaths replaces the paths of the files of the package with rewrite.
+// ExportFile is left as is, since go/packages reads it.
+func (fp *FlatPackage) RewritePaths(rewrite PathResolverFunc) {
+	resolvePathsInPlace(rewrite, fp.GoFiles)
+	resolvePathsInPlace(rewrite, fp.CompiledGoFiles)
+	resolvePathsInPlace(rewrite, fp.OtherFiles)
+	resolvePathsInPlace(rewrite, fp.IgnoredFiles)
+	resolvePathsInPlace(rewrite, fp.EmbedFiles)
+	if len(fp.GeneratedFiles) > 0 {
+		generatedFiles := make(map[string]string, len(fp.GeneratedFiles))
+		for f, label := range fp.GeneratedFiles {
+			generatedFiles[rewrite(f)] = label
+		}
+		fp.GeneratedFiles = generatedFiles
+	}
+}
+
+// LinkGeneratedFiles replaces the generated sources of the package with
+// symlinks to them in dir, which editors can open like any workspace file.
+// The links are laid out like the packages of the rules generating them.
+func (fp *FlatPackage) LinkGeneratedFiles(dir string) error {
+	if len(fp.GeneratedFiles) == 0 {
+		return nil
+	}
+	generatedFiles := make(map[string]string, len(fp.GeneratedFiles))
+	for f, label := range fp.GeneratedFiles {
+		link := filepath.Join(dir, generatedFileLinkDir(label), filepath.Base(f))
+		if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+			return fmt.Errorf("unable to create directory for %s: %w", link, err)
+		}
+		if target, err := os.Readlink(link); err != nil || target != f {
+			os.Remove(link)
+			if err := os.Symlink(f, link); err != nil {
+				return fmt.Errorf("unable to link %s: %w", f, err)
+			}
+		}
+		for _, files := range [][]string{fp.GoFiles, fp.CompiledGoFiles, fp.OtherFiles, fp.IgnoredFiles} {
+			for i := range files {
+				if files[i] == f {
+					files[i] = link
+				}
+			}
+		}
+		generatedFiles[link] = label
+	}
+	fp.GeneratedFiles = generatedFiles
+	return nil
+}
+
+// generatedFileLinkDir returns the directory of the links to the files
+// generated by label, relative to the links directory: the package of label,
+// under the name of its repository if it's external.
+func generatedFileLinkDir(label string) string {
+	repo, rest, _ := strings.Cut(strings.TrimLeft(label, "@"), "//")
+	pkg, _, _ := strings.Cut(rest, ":")
+	return filepath.Join(repo, filepath.FromSlash(pkg))
+}
+
+// expandCgoGoFiles moves the Go files generated by cgo out of the directories
+// the aspect lists in CompiledGoFiles. Directories that don't exist, because
+// the package failed to build, are dropped.
+func (fp *FlatPackage) expandCgoGoFiles() {
+	compiledGoFiles := fp.CompiledGoFiles[:0]
+	for _, f := range fp.CompiledGoFiles {
+		if filepath.Ext(f) != ".cgo" {
+			compiledGoFiles = append(compiledGoFiles, f)
+			continue
+		}
+		entries, err := os.ReadDir(f)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".go") {
+				fp.cgoGoFiles = append(fp.cgoGoFiles, filepath.Join(f, e.Name()))
+			}
+		}
+	}
+	fp.CompiledGoFiles = compiledGoFiles
+}
+
+// FilterFilesForBuildTags drops the files excluded by build constraints from
+// GoFiles, CompiledGoFiles and OtherFiles, and reports those of the first and
+// last in IgnoredFiles like go list. Assembly and C sources for other
+// platforms thus aren't analyzed along with the package.
 func (fp *FlatPackage) FilterFilesForBuildTags() {
-	fp.GoFiles = filterSourceFilesForTags(fp.GoFiles)
-	fp.CompiledGoFiles = filterSourceFilesForTags(fp.CompiledGoFiles)
+	bctx := buildContextWithTags(fp.BuildTags)
+	var ignoredGoFiles, ignoredOtherFiles []string
+	fp.GoFiles, ignoredGoFiles = partitionSourceFilesForTags(bctx, fp.GoFiles)
+	fp.CompiledGoFiles = filterSourceFilesForTags(bctx, fp.CompiledGoFiles)
+	fp.OtherFiles, ignoredOtherFiles = partitionSourceFilesForTags(bctx, fp.OtherFiles)
+	fp.IgnoredFiles = append(append(fp.IgnoredFiles, ignoredGoFiles...), ignoredOtherFiles...)
+	if len(fp.cgoGoFiles) > 0 {
+		fp.CompiledGoFiles = replaceCgoSources(fp.CompiledGoFiles, fp.cgoGoFiles)
+	}
+}
+
+// replaceCgoSources replaces each Go file processed by cgo with the file cgo
+// generated from it (x.go becomes x.cgo1.go), and adds the other generated
+// files such as _cgo_gotypes.go. This matches CompiledGoFiles in go list.
+// The generated files were already filtered by build tags when compiling.
+func replaceCgoSources(files []string, cgoGoFiles []string) []string {
+	generated := map[string]struct{}{}
+	for _, f := range cgoGoFiles {
+		if base, ok := strings.CutSuffix(filepath.Base(f), ".cgo1.go"); ok {
+			generated[base+".go"] = struct{}{}
+		}
+	}
+
+	ret := make([]string, 0, len(files)+len(cgoGoFiles))
+	for _, f := range files {
+		if _, ok := generated[filepath.Base(f)]; !ok {
+			ret = append(ret, f)
+		}
+	}
+	return append(ret, cgoGoFiles...)
 }
 
-func (fp *FlatPackage) filterTestSuffix(files []string) (err error, testFiles []string, xTestFiles, nonTestFiles []string) {
+// parsePackageName returns the package name declared in file, using its
+// overlay contents if there are any.
+func parsePackageName(file string, overlays map[string][]byte) (string, error) {
+	// ParseFile checks the type of src, so only set it when an overlay exists.
+	var src io.Reader
+	if content, ok := overlays[file]; ok {
+		src = bytes.NewReader(content)
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), file, src, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	return f.Name.Name, nil
+}
+
+func (fp *FlatPackage) filterTestSuffix(files []string, overlays map[string][]byte) (err error, testFiles []string, xTestFiles, nonTestFiles []string) {
 	for _, filename := range files {
 		if strings.HasSuffix(filename, "_test.go") {
-			fset := token.NewFileSet()
-			f, err := parser.ParseFile(fset, filename, nil, parser.PackageClauseOnly)
+			name, err := parsePackageName(filename, overlays)
 			if err != nil {
 				return err, nil, nil, nil
 			}
-			if f.Name.Name == fp.Name {
+			// Like go/build, only treat files of a "_test" package other than
+			// fp as external tests. The package name may not be known yet if
+			// it wasn't set by the aspect.
+			if name == fp.Name || !strings.HasSuffix(name, "_test") {
 				testFiles = append(testFiles, filename)
 			} else {
 				xTestFiles = append(xTestFiles, filename)
@@ -132,15 +318,20 @@ func (fp *FlatPackage) filterTestSuffix(files []string) (err error, testFiles []
 	return
 }
 
-func (fp *FlatPackage) MoveTestFiles() *FlatPackage {
-	err, tgf, xtgf, gf := fp.filterTestSuffix(fp.GoFiles)
+// MoveTestFiles moves the external test files of fp into their own package.
+// If xtest is not nil, it's the external test package reported by the aspect,
+// which already has its ID, PkgPath and Imports; its files are replaced with
+// the external test files. Otherwise a new package is derived from fp. It
+// returns nil if fp has no external test files.
+func (fp *FlatPackage) MoveTestFiles(xtest *FlatPackage, overlays map[string][]byte) *FlatPackage {
+	err, tgf, xtgf, gf := fp.filterTestSuffix(fp.GoFiles, overlays)
 	if err != nil {
 		return nil
 	}
 
 	fp.GoFiles = append(gf, tgf...)
 
-	err, ctgf, cxtgf, cgf := fp.filterTestSuffix(fp.CompiledGoFiles)
+	err, ctgf, cxtgf, cgf := fp.filterTestSuffix(fp.CompiledGoFiles, overlays)
 	if err != nil {
 		return nil
 	}
@@ -151,6 +342,16 @@ func (fp *FlatPackage) MoveTestFiles() *FlatPackage {
 		return nil
 	}
 
+	if xtest != nil {
+		xtest.GoFiles = append([]string{}, xtgf...)
+		xtest.CompiledGoFiles = append([]string{}, cxtgf...)
+		if xtest.Imports == nil {
+			xtest.Imports = map[string]string{}
+		}
+		xtest.Imports[fp.PkgPath] = fp.ID
+		return xtest
+	}
+
 	newImports := make(map[string]string, len(fp.Imports))
 	for k, v := range fp.Imports {
 		newImports[k] = v
@@ -170,9 +371,79 @@ func (fp *FlatPackage) MoveTestFiles() *FlatPackage {
 		OtherFiles:      fp.OtherFiles,
 		ExportFile:      fp.ExportFile,
 		Standard:        fp.Standard,
+		ForTest:         fp.ForTest,
 	}
 }
 
+// Prune drops the fields go/packages will not use when loading with mode so
+// that they aren't serialized in the response.
+func (fp *FlatPackage) Prune(mode LoadMode) {
+	mode = mode.implied()
+	if mode&NeedFiles == 0 {
+		fp.GoFiles = nil
+		fp.OtherFiles = nil
+		fp.IgnoredFiles = nil
+		fp.GeneratedFiles = nil
+		fp.BuildTags = nil
+	}
+	if !mode.needsCompiledGoFiles() {
+		fp.CompiledGoFiles = nil
+	}
+	if !mode.needsExportFile() {
+		fp.ExportFile = ""
+	}
+	if mode&NeedImports == 0 {
+		fp.Imports = nil
+	}
+	if mode&NeedModule == 0 {
+		fp.Module = nil
+	}
+	if mode&NeedEmbedFiles == 0 {
+		fp.EmbedFiles = nil
+	}
+	if mode&NeedEmbedPatterns == 0 {
+		fp.EmbedPatterns = nil
+	}
+}
+
+// acceptsOverlayFile reports whether a new file of package name in dir belongs
+// to fp, which is the case if fp has sources of the same package in dir. Test
+// files are only added to packages that already have test files.
+func (fp *FlatPackage) acceptsOverlayFile(dir, name string, isTest bool, overlays map[string][]byte) bool {
+	var pkgName string
+	var hasTests bool
+	for _, f := range fp.GoFiles {
+		if filepath.Dir(f) != dir {
+			continue
+		}
+		if strings.HasSuffix(f, "_test.go") {
+			hasTests = true
+			continue
+		}
+		if pkgName == "" {
+			pkgName, _ = parsePackageName(f, overlays)
+		}
+	}
+	if pkgName == "" || isTest && !hasTests {
+		return false
+	}
+	return name == pkgName || isTest && name == pkgName+"_test"
+}
+
+// fileWithSuffix returns the source of the package whose path ends with the
+// relative path rel, as printed by actions running in the execution root.
+func (fp *FlatPackage) fileWithSuffix(rel string) string {
+	suffix := string(filepath.Separator) + filepath.FromSlash(rel)
+	for _, files := range [][]string{fp.CompiledGoFiles, fp.GoFiles} {
+		for _, f := range files {
+			if strings.HasSuffix(f, suffix) {
+				return f
+			}
+		}
+	}
+	return ""
+}
+
 func (fp *FlatPackage) IsStdlib() bool {
 	return fp.Standard
 }
@@ -186,6 +457,7 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc, overlays map[strin
 	}
 
 	fset := token.NewFileSet()
+	sourceImports := map[string]bool{}
 
 	for _, file := range fp.CompiledGoFiles {
 		// Only assign overlayContent when an overlay for the file exists, since ParseFile checks by type.
@@ -213,6 +485,7 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc, overlays map[strin
 			if imp == "C" {
 				continue
 			}
+			sourceImports[imp] = true
 			if _, ok := fp.Imports[imp]; ok {
 				continue
 			}
@@ -223,9 +496,120 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc, overlays map[strin
 		}
 	}
 
+	// Imports is keyed by the import paths of the dependencies, which for
+	// vendored packages may include the vendor directory the sources don't
+	// spell out.
+	for imp, pkgID := range fp.Imports {
+		stripped := stripVendorPrefix(imp)
+		if stripped == imp || sourceImports[imp] {
+			continue
+		}
+		delete(fp.Imports, imp)
+		if _, ok := fp.Imports[stripped]; !ok {
+			fp.Imports[stripped] = pkgID
+		}
+	}
+
 	return nil
 }
 
+// ResolveEmbedPatterns sets EmbedPatterns from the //go:embed directives in
+// the sources of the package. EmbedFiles come from the embedsrcs of the
+// target, which are the files the patterns may match.
+func (fp *FlatPackage) ResolveEmbedPatterns(overlays map[string][]byte) {
+	// Stdlib packages come with their patterns from go list.
+	if fp.IsStdlib() {
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, file := range fp.GoFiles {
+		content, ok := overlays[file]
+		if !ok {
+			var err error
+			if content, err = os.ReadFile(file); err != nil {
+				continue
+			}
+		}
+		for _, pattern := range parseEmbedPatterns(content) {
+			if !seen[pattern] {
+				seen[pattern] = true
+				fp.EmbedPatterns = append(fp.EmbedPatterns, pattern)
+			}
+		}
+	}
+}
+
+// parseEmbedPatterns returns the patterns of the //go:embed directives in the
+// Go source src. Like go/build, only the directives in the doc comments of var
+// declarations are considered, so lines that merely look like directives in
+// strings or block comments are ignored.
+func parseEmbedPatterns(src []byte) []string {
+	// A file with syntax errors still has the declarations before them.
+	f, _ := parser.ParseFile(token.NewFileSet(), "", src, parser.ParseComments)
+	if f == nil {
+		return nil
+	}
+	var patterns []string
+	for _, decl := range f.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok || d.Tok != token.VAR {
+			continue
+		}
+		docs := []*ast.CommentGroup{d.Doc}
+		for _, spec := range d.Specs {
+			docs = append(docs, spec.(*ast.ValueSpec).Doc)
+		}
+		for _, doc := range docs {
+			if doc == nil {
+				continue
+			}
+			for _, c := range doc.List {
+				args, ok := strings.CutPrefix(c.Text, "//go:embed")
+				if !ok || args == "" || (args[0] != ' ' && args[0] != '\t') {
+					continue
+				}
+				patterns = append(patterns, parseEmbedArgs(args)...)
+			}
+		}
+	}
+	return patterns
+}
+
+// parseEmbedArgs splits the arguments of a //go:embed directive into patterns,
+// which may be quoted like string literals.
+func parseEmbedArgs(args string) []string {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		var pattern string
+		if args[0] == '"' || args[0] == '`' {
+			quoted, err := strconv.QuotedPrefix(args)
+			if err != nil {
+				break
+			}
+			pattern, _ = strconv.Unquote(quoted)
+			args = args[len(quoted):]
+		} else {
+			end := strings.IndexFunc(args, unicode.IsSpace)
+			if end < 0 {
+				end = len(args)
+			}
+			pattern, args = args[:end], args[end:]
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// stripVendorPrefix returns the path a package vendored at importPath is
+// imported with, dropping everything up to the innermost vendor directory.
+func stripVendorPrefix(importPath string) string {
+	if i := strings.LastIndex(importPath, "/vendor/"); i >= 0 {
+		return importPath[i+len("/vendor/"):]
+	}
+	return strings.TrimPrefix(importPath, "vendor/")
+}
+
 func (fp *FlatPackage) IsRoot() bool {
 	return strings.HasPrefix(fp.ID, "//")
 }
@@ -4,11 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
 )
@@ -76,6 +83,200 @@ import "os"
 func main() {
 	fmt.Fprintln(os.Stderr, "Subdirectory Hello World!")
 }
+
+-- cgohello/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "cgohello",
+    srcs = [
+        "cgohello.go",
+        "plain.go",
+    ],
+    cgo = True,
+    importpath = "example.com/hello/cgohello",
+    visibility = ["//visibility:public"],
+)
+
+-- cgohello/cgohello.go --
+package cgohello
+
+// int answer() { return 42; }
+import "C"
+
+func Answer() int {
+	return int(C.answer())
+}
+
+-- cgohello/plain.go --
+package cgohello
+
+-- generated/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+genrule(
+    name = "gen",
+    outs = ["gen.go"],
+    cmd = "echo 'package generated' > $@",
+)
+
+go_library(
+    name = "generated",
+    srcs = [":gen.go"],
+    importpath = "example.com/hello/generated",
+    visibility = ["//visibility:public"],
+)
+
+-- vendor/example.com/dep/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "dep",
+    srcs = ["dep.go"],
+    importpath = "example.com/hello/vendor/example.com/dep",
+    visibility = ["//visibility:public"],
+)
+
+-- vendor/example.com/dep/dep.go --
+package dep
+
+-- racy/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "racy",
+    srcs = [
+        "norace.go",
+        "race.go",
+    ],
+    importpath = "example.com/hello/racy",
+    visibility = ["//visibility:public"],
+)
+
+-- racy/race.go --
+//go:build race
+
+package racy
+
+-- racy/norace.go --
+//go:build !race
+
+package racy
+
+-- embedded/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "embedded",
+    srcs = ["embedded.go"],
+    embedsrcs = ["data.txt"],
+    importpath = "example.com/hello/embedded",
+    visibility = ["//visibility:public"],
+)
+
+-- embedded/embedded.go --
+package embedded
+
+import _ "embed"
+
+//go:embed data.txt
+var data string
+
+-- embedded/data.txt --
+data
+
+-- tagged/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "tagged",
+    srcs = [
+        "foo.go",
+        "foo.s",
+        "nofoo.go",
+    ],
+    importpath = "example.com/hello/tagged",
+    visibility = ["//visibility:public"],
+)
+
+-- tagged/foo.go --
+//go:build foo
+
+package tagged
+
+-- tagged/foo.s --
+//go:build foo
+
+-- tagged/nofoo.go --
+//go:build !foo
+
+package tagged
+
+-- broken/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "broken",
+    srcs = ["broken.go"],
+    importpath = "example.com/hello/broken",
+    visibility = ["//visibility:public"],
+)
+
+-- broken/broken.go --
+package broken
+
+func Broken() int {
+	return undefined
+}
+
+-- dotless/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "dotless",
+    srcs = ["dotless.go"],
+    importpath = "mycompany/dotless",
+    visibility = ["//visibility:public"],
+)
+
+-- dotless/dotless.go --
+package dotless
+
+-- module/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "module",
+    srcs = ["module.go"],
+    importpath = "example.com/module",
+    visibility = ["//visibility:public"],
+)
+
+-- module/go.mod --
+module example.com/module
+
+go 1.21
+
+-- module/module.go --
+package module
+
+-- header/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "header",
+    srcs = [
+        "header.go",
+        "header.h",
+    ],
+    importpath = "example.com/hello/header",
+    visibility = ["//visibility:public"],
+)
+
+-- header/header.go --
+package header
+
+-- header/header.h --
 		`,
 	})
 }
@@ -112,6 +313,67 @@ func TestStdlib(t *testing.T) {
 	}
 }
 
+func TestBuiltin(t *testing.T) {
+	resp := runForTest(t, DriverRequest{}, ".", "builtin")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	if pkg.PkgPath != "builtin" {
+		t.Errorf("Expected the builtin package as root: %+v", pkg)
+	}
+	assertSuffixesInList(t, pkg.GoFiles, "/src/builtin/builtin.go")
+}
+
+func TestStdlibExportFile(t *testing.T) {
+	resp := runForTest(t, DriverRequest{Mode: NeedName | NeedExportFile}, ".", "os")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+	if pkg.ExportFile == "" {
+		t.Fatalf("Expected os to have an export file:\n%+v", pkg)
+	}
+	if _, err := os.Stat(pkg.ExportFile); err != nil {
+		t.Errorf("Expected the export file of os to be built: %v", err)
+	}
+}
+
+func TestStdlibImportPath(t *testing.T) {
+	resp := runForTest(t, DriverRequest{}, ".", "os")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+
+	if resp.Roots[0] != osPkgID && resp.Roots[0] != bzlmodOsPkgID {
+		t.Errorf("Expected root to be %q or %q, got %q", osPkgID, bzlmodOsPkgID, resp.Roots[0])
+	}
+
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	if !pkg.Standard || len(pkg.GoFiles) == 0 {
+		t.Errorf("Expected os to be a standard package with sources:\n%+v", pkg)
+	}
+}
+
+func TestDotlessImportPath(t *testing.T) {
+	// Without a query scope, an import path without a dot in its first
+	// element may still name a workspace package.
+	resp := runForTest(t, DriverRequest{Mode: NeedName}, ".", "mycompany/dotless")
+
+	if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//dotless:dotless") {
+		t.Fatalf("Expected //dotless:dotless as the only root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+	if pkg.PkgPath != "mycompany/dotless" || pkg.Standard {
+		t.Errorf("Expected the workspace package mycompany/dotless: %+v", pkg)
+	}
+}
+
 func TestBaseFileLookup(t *testing.T) {
 	resp := runForTest(t, DriverRequest{}, ".", "file=hello.go")
 
@@ -177,6 +439,307 @@ func TestBaseFileLookup(t *testing.T) {
 	})
 }
 
+func TestLoadModePruning(t *testing.T) {
+	resp := runForTest(t, DriverRequest{Mode: NeedName | NeedFiles}, ".", "file=hello.go")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+
+	if len(resp.Packages) != 1 {
+		t.Errorf("Expected only the root package without NeedImports: %+v", resp.Packages)
+	}
+
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	assertSuffixesInList(t, pkg.GoFiles, "/hello.go")
+	if len(pkg.CompiledGoFiles) != 0 || pkg.ExportFile != "" || len(pkg.Imports) != 0 {
+		t.Errorf("Expected CompiledGoFiles, ExportFile and Imports to be pruned:\n%+v", pkg)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	resp := runForTest(t, DriverRequest{}, ".", "file=hello.go")
+
+	// The test workspace builds for the host platform.
+	if resp.Compiler != "gc" || resp.Arch != runtime.GOARCH {
+		t.Errorf("Expected sizes for gc/%s, got %s/%s", runtime.GOARCH, resp.Compiler, resp.Arch)
+	}
+}
+
+func TestModule(t *testing.T) {
+	resp := runForTest(t, DriverRequest{Mode: NeedName | NeedModule}, ".", "file=module/module.go")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	m := pkg.Module
+	if m == nil {
+		t.Fatalf("Expected Module to be set: %+v", pkg)
+	}
+	if m.Path != "example.com/module" || !m.Main || m.GoVersion != "1.21" || !strings.HasSuffix(m.GoMod, "/module/go.mod") {
+		t.Errorf("Unexpected module: %+v", m)
+	}
+}
+
+func TestGeneratedFiles(t *testing.T) {
+	oldGeneratedFilesDir := generatedFilesDir
+	generatedFilesDir = "bazel-generated"
+	defer func() {
+		generatedFilesDir = oldGeneratedFilesDir
+	}()
+
+	resp := runForTest(t, DriverRequest{}, "generated", "./...")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	if len(pkg.GoFiles) != 1 || !strings.HasSuffix(pkg.GoFiles[0], "/bazel-generated/generated/gen.go") {
+		t.Fatalf("Expected the generated file to be linked: %+v", pkg.GoFiles)
+	}
+	if info, err := os.Lstat(pkg.GoFiles[0]); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected %s to be a symlink: %v", pkg.GoFiles[0], err)
+	}
+	if label := pkg.GeneratedFiles[pkg.GoFiles[0]]; !strings.HasSuffix(label, "//generated:gen") {
+		t.Errorf("Expected the file to be generated by //generated:gen: %+v", pkg.GeneratedFiles)
+	}
+}
+
+func TestVendoredPackage(t *testing.T) {
+	resp := runForTest(t, DriverRequest{Mode: NeedName | NeedExportFile}, ".", "file=vendor/example.com/dep/dep.go")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	if pkg.PkgPath != "example.com/dep" {
+		t.Errorf("Expected the vendor prefix to be stripped from PkgPath: %q", pkg.PkgPath)
+	}
+	if !strings.Contains(pkg.ExportFile, "/vendor/example.com/dep/") {
+		t.Errorf("Expected ExportFile to point at the vendored archive: %q", pkg.ExportFile)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	// The configuration file is kept out of the workspace shared by the
+	// other tests.
+	dir := t.TempDir()
+	config := `{"targets": ["//subhello/..."], "build_flags": ["--verbose_failures"]}`
+	if err := os.WriteFile(filepath.Join(dir, configFileName), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBuildFlags, oldDefaultQuery := bazelBuildFlags, bazelDefaultQuery
+	defer func() {
+		bazelBuildFlags, bazelDefaultQuery = oldBuildFlags, oldDefaultQuery
+	}()
+	cfg, err := loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.apply()
+
+	// Without patterns, the targets of the configuration file are loaded.
+	resp := runForTest(t, DriverRequest{}, ".")
+	if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//subhello:subhello") {
+		t.Errorf("Expected only //subhello:subhello as root: %+v", resp.Roots)
+	}
+}
+
+func TestFileOutsideWorkspace(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "outside.go")
+	if err := os.WriteFile(f, []byte("package outside\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// go/packages falls back to go list for requests the driver doesn't handle.
+	resp := runForTest(t, DriverRequest{}, ".", "file="+f)
+	if !resp.NotHandled {
+		t.Errorf("Expected the request not to be handled: %+v", resp)
+	}
+}
+
+func TestRaceVariant(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		wantFile string
+	}{
+		{args: []string{"./..."}, wantFile: "norace.go"},
+		{args: []string{"--variant=race", "./..."}, wantFile: "race.go"},
+	} {
+		resp := runForTest(t, DriverRequest{Mode: NeedName | NeedFiles}, "racy", tc.args...)
+		if len(resp.Roots) != 1 {
+			t.Fatalf("Expected 1 package root for %v: %+v", tc.args, resp.Roots)
+		}
+		pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+		if len(pkg.GoFiles) != 1 || path.Base(pkg.GoFiles[0]) != tc.wantFile {
+			t.Errorf("Expected only %s in GoFiles for %v: %+v", tc.wantFile, tc.args, pkg.GoFiles)
+		}
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	for _, tc := range []struct {
+		args        []string
+		buildFlags  []string
+		wantFile    string
+		wantIgnored []string
+		wantOther   []string
+	}{
+		{args: []string{"./..."}, wantFile: "nofoo.go", wantIgnored: []string{"/foo.go", "/foo.s"}},
+		{args: []string{"./..."}, buildFlags: []string{"-tags=foo"}, wantFile: "foo.go", wantIgnored: []string{"/nofoo.go"}, wantOther: []string{"/foo.s"}},
+		{args: []string{"--tags=foo", "./..."}, wantFile: "foo.go", wantIgnored: []string{"/nofoo.go"}, wantOther: []string{"/foo.s"}},
+		{args: []string{"--tags=", "./..."}, buildFlags: []string{"-tags", "foo"}, wantFile: "nofoo.go", wantIgnored: []string{"/foo.go", "/foo.s"}},
+	} {
+		resp := runForTest(t, DriverRequest{Mode: NeedName | NeedFiles, BuildFlags: tc.buildFlags}, "tagged", tc.args...)
+		if len(resp.Roots) != 1 {
+			t.Fatalf("Expected 1 package root for %v %v: %+v", tc.args, tc.buildFlags, resp.Roots)
+		}
+		pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+		if len(pkg.GoFiles) != 1 || path.Base(pkg.GoFiles[0]) != tc.wantFile {
+			t.Errorf("Expected only %s in GoFiles for %v %v: %+v", tc.wantFile, tc.args, tc.buildFlags, pkg.GoFiles)
+		}
+		if len(pkg.IgnoredFiles) != len(tc.wantIgnored) || len(pkg.OtherFiles) != len(tc.wantOther) {
+			t.Errorf("Expected %v in IgnoredFiles and %v in OtherFiles for %v %v: %+v", tc.wantIgnored, tc.wantOther, tc.args, tc.buildFlags, pkg)
+		}
+		assertSuffixesInList(t, pkg.IgnoredFiles, tc.wantIgnored...)
+		assertSuffixesInList(t, pkg.OtherFiles, tc.wantOther...)
+	}
+}
+
+func TestPathModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode  string
+		check func(f string) bool
+	}{
+		{mode: "absolute", check: func(f string) bool { return filepath.IsAbs(f) && strings.HasSuffix(f, "/hello.go") }},
+		{mode: "relative", check: func(f string) bool { return f == "hello.go" }},
+		{mode: "execroot", check: func(f string) bool { return strings.Contains(f, "/execroot/") && strings.HasSuffix(f, "/hello.go") }},
+		{mode: "resolved", check: func(f string) bool { return filepath.IsAbs(f) && strings.HasSuffix(f, "/hello.go") }},
+	} {
+		resp := runForTest(t, DriverRequest{Mode: NeedName | NeedFiles}, ".", "--paths="+tc.mode, "//:hello")
+		if len(resp.Roots) != 1 {
+			t.Fatalf("Expected 1 package root with %s paths: %+v", tc.mode, resp.Roots)
+		}
+		pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+		if len(pkg.GoFiles) != 1 || !tc.check(pkg.GoFiles[0]) {
+			t.Errorf("Unexpected GoFiles with %s paths: %+v", tc.mode, pkg.GoFiles)
+		}
+	}
+}
+
+func TestDebugProfile(t *testing.T) {
+	dir := t.TempDir()
+	runForTest(t, DriverRequest{}, ".", "--debug-profile="+dir, "//:hello")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected one profile directory: %+v", entries)
+	}
+	profileDir := filepath.Join(dir, entries[0].Name())
+	for _, name := range []string{"cpu.pprof", "heap.pprof"} {
+		if _, err := os.Stat(filepath.Join(profileDir, name)); err != nil {
+			t.Errorf("Expected %s in the profile: %v", name, err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(profileDir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary debugSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	var phases []string
+	for _, phase := range summary.Phases {
+		phases = append(phases, phase.Name)
+	}
+	expectSetEquality(t, []string{"bazel info", "query", "build", "load", "response"}, phases, "phases")
+	if summary.Packages == 0 || summary.Files == 0 {
+		t.Errorf("Expected packages and files to be counted: %+v", summary)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	report := &bytes.Buffer{}
+	runDiagnose := func(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+		if err := diagnose(ctx, report, args); err != nil {
+			return fmt.Errorf("%w:\n%s", err, report)
+		}
+		return json.NewEncoder(out).Encode(emptyResponse)
+	}
+	runForTestWith(t, runDiagnose, DriverRequest{}, ".", "//:hello")
+
+	for _, check := range []string{"bazel", "aspect", "build", "rules_go version", "load"} {
+		if !strings.Contains(report.String(), "ok    "+check+":") {
+			t.Errorf("Expected check %q to pass:\n%s", check, report)
+		}
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	resp := runForTest(t, DriverRequest{Mode: NeedName | NeedEmbedFiles | NeedEmbedPatterns}, ".", "file=embedded/embedded.go")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	if !reflect.DeepEqual(pkg.EmbedPatterns, []string{"data.txt"}) {
+		t.Errorf("Expected data.txt as the only embed pattern: %+v", pkg.EmbedPatterns)
+	}
+	if len(pkg.EmbedFiles) != 1 || !strings.HasSuffix(pkg.EmbedFiles[0], "/embedded/data.txt") {
+		t.Errorf("Expected data.txt as the only embedded file: %+v", pkg.EmbedFiles)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := writeCapabilities(out); err != nil {
+		t.Fatalf("writeCapabilities: %v", err)
+	}
+	var caps driverCapabilities
+	if err := json.Unmarshal(out.Bytes(), &caps); err != nil {
+		t.Fatalf("unable to decode capabilities: %v", err)
+	}
+	if caps.Version != driverProtocolVersion {
+		t.Errorf("Expected version %d, got %d", driverProtocolVersion, caps.Version)
+	}
+	assertSuffixesInList(t, caps.Features, featureOverlay, featureStdlib, featureTests)
+	expectSetEquality(t, []string{"msan", "race"}, caps.Variants, "variants")
+
+	resp := runForTest(t, DriverRequest{}, ".", "//:hello")
+	if resp.Capabilities == nil || resp.Capabilities.Version != driverProtocolVersion {
+		t.Errorf("Expected capabilities in the response: %+v", resp.Capabilities)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	resp := runForTest(t, DriverRequest{Mode: NeedName | NeedFiles | NeedExportFile}, ".", "file=broken/broken.go")
+
+	if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//broken:broken") {
+		t.Fatalf("Expected //broken:broken as the only root: %+v", resp.Roots)
+	}
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	if len(pkg.Errors) == 0 {
+		t.Fatalf("Expected the compile error in Errors: %+v", pkg)
+	}
+	err := pkg.Errors[0]
+	if !strings.HasSuffix(err.Pos, "/broken/broken.go:4:9") || !strings.Contains(err.Msg, "undefined") || err.Kind != TypeError {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+}
+
 func TestRelativeFileLookup(t *testing.T) {
 	resp := runForTest(t, DriverRequest{}, "subhello", "file=./subhello.go")
 
@@ -208,6 +771,21 @@ func TestRelativeFileLookup(t *testing.T) {
 	})
 }
 
+func TestNonGoFileLookup(t *testing.T) {
+	resp := runForTest(t, DriverRequest{}, ".", "file=header/header.h")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+
+	if !strings.HasSuffix(resp.Roots[0], "//header:header") {
+		t.Fatalf("Unexpected package id: %q", resp.Roots[0])
+	}
+
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+	assertSuffixesInList(t, pkg.OtherFiles, "/header.h")
+}
+
 func TestRelativePatternWildcardLookup(t *testing.T) {
 	resp := runForTest(t, DriverRequest{}, "subhello", "./...")
 
@@ -239,16 +817,42 @@ func TestRelativePatternWildcardLookup(t *testing.T) {
 	})
 }
 
+func TestWorkspacePatternWildcardLookup(t *testing.T) {
+	resp := runForTest(t, DriverRequest{}, ".", "./...")
+
+	assertSuffixesInList(t, resp.Roots, "//:hello", "//subhello:subhello", "//cgohello:cgohello", "//generated:generated", "//vendor/example.com/dep:dep", "//racy:racy", "//embedded:embedded", "//tagged:tagged", "//broken:broken", "//dotless:dotless", "//module:module", "//header:header")
+}
+
+func TestCgoCompiledGoFiles(t *testing.T) {
+	resp := runForTest(t, DriverRequest{}, ".", "file=cgohello/cgohello.go")
+
+	if len(resp.Roots) != 1 {
+		t.Fatalf("Expected 1 package root: %+v", resp.Roots)
+	}
+
+	pkg := mustFindPackage(t, resp.Packages, resp.Roots[0])
+
+	assertSuffixesInList(t, pkg.GoFiles, "/cgohello.go", "/plain.go")
+	assertSuffixesInList(t, pkg.CompiledGoFiles, "/cgohello.cgo1.go", "/_cgo_gotypes.go", "/plain.go")
+	for _, f := range pkg.CompiledGoFiles {
+		if strings.HasSuffix(f, "/cgohello.go") {
+			t.Errorf("Expected cgohello.go to be replaced by generated files in CompiledGoFiles: %+v", pkg.CompiledGoFiles)
+		}
+	}
+}
+
 func TestExternalTests(t *testing.T) {
 	resp := runForTest(t, DriverRequest{}, ".", "file=hello_external_test.go")
-	if len(resp.Roots) != 2 {
-		t.Errorf("Expected exactly two roots for package: %+v", resp.Roots)
+	if len(resp.Roots) != 3 {
+		t.Errorf("Expected exactly three roots for package: %+v", resp.Roots)
 	}
 
-	var testId, xTestId string
+	var testId, xTestId, testMainId string
 	for _, id := range resp.Roots {
 		if strings.HasSuffix(id, "_xtest") {
 			xTestId = id
+		} else if strings.HasSuffix(id, "_testmain") {
+			testMainId = id
 		} else {
 			testId = id
 		}
@@ -260,8 +864,28 @@ func TestExternalTests(t *testing.T) {
 				t.Errorf("PkgPath missing _test suffix")
 			}
 			assertSuffixesInList(t, p.GoFiles, "/hello_external_test.go")
+			if p.Imports["example.com/hello"] != testId {
+				t.Errorf("Expected xtest package to import %q as %q: %+v", "example.com/hello", testId, p.Imports)
+			}
+			if p.ForTest != "example.com/hello" {
+				t.Errorf("Expected xtest package to be for example.com/hello, got %q", p.ForTest)
+			}
 		} else if p.ID == testId {
 			assertSuffixesInList(t, p.GoFiles, "/hello.go", "/hello_test.go")
+			if p.ForTest != "example.com/hello" {
+				t.Errorf("Expected test package to be for example.com/hello, got %q", p.ForTest)
+			}
+		} else if p.ID == testMainId {
+			if p.Name != "main" || p.PkgPath != "example.com/hello.test" {
+				t.Errorf("Expected test main package main with PkgPath example.com/hello.test, got %q %q", p.Name, p.PkgPath)
+			}
+			if p.Imports["example.com/hello"] != testId || p.Imports["example.com/hello_test"] != xTestId {
+				t.Errorf("Expected test main to import both test packages: %+v", p.Imports)
+			}
+			if id := p.Imports["github.com/bazelbuild/rules_go/go/tools/bzltestutil"]; !strings.HasSuffix(id, "//go/tools/bzltestutil:bzltestutil") {
+				t.Errorf("Expected test main to import bzltestutil, got %q: %+v", id, p.Imports)
+			}
+			assertSuffixesInList(t, p.GoFiles, "/testmain.go")
 		}
 	}
 }
@@ -324,8 +948,425 @@ func TestOverlay(t *testing.T) {
 	expectSetEquality(t, expectedImportsPerFile[subhelloPath], subhelloPkgImportPaths, "subhello imports")
 }
 
+func TestOverlayNewFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFilePath := path.Join(wd, "hello_unsaved.go")
+	newTestFilePath := path.Join(wd, "hello_unsaved_test.go")
+	overlayDriverRequest := DriverRequest{
+		Tests: true,
+		Overlay: map[string][]byte{
+			newFilePath: []byte(`
+				package hello
+				import "strings"
+			`),
+			newTestFilePath: []byte(`
+				package hello_test
+				import "errors"
+			`),
+		},
+	}
+
+	resp := runForTest(t, overlayDriverRequest, ".", "file=hello_test.go")
+
+	var testPkg, xTestPkg *FlatPackage
+	for _, p := range resp.Packages {
+		if strings.HasSuffix(p.ID, "//:hello_test") {
+			testPkg = p
+		} else if strings.HasSuffix(p.ID, "//:hello_test_xtest") {
+			xTestPkg = p
+		}
+	}
+	if testPkg == nil || xTestPkg == nil {
+		t.Fatalf("Expected test and xtest packages in response: %+v", resp.Roots)
+	}
+
+	assertSuffixesInList(t, testPkg.GoFiles, "/hello_unsaved.go")
+	assertSuffixesInList(t, xTestPkg.GoFiles, "/hello_unsaved_test.go")
+	if _, ok := testPkg.Imports["strings"]; !ok {
+		t.Errorf("Expected test package to import strings from the overlay: %+v", testPkg.Imports)
+	}
+	if _, ok := xTestPkg.Imports["errors"]; !ok {
+		t.Errorf("Expected xtest package to import errors from the overlay: %+v", xTestPkg.Imports)
+	}
+}
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newServer(false).serve(ctx, l)
+
+	runClientFunc := func(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return err
+		}
+		return runClient(conn, in, out, args)
+	}
+
+	// The second request is answered from the warm state of the first, and
+	// compressed.
+	oldServerGzip := serverGzip
+	defer func() { serverGzip = oldServerGzip }()
+	for _, relativeWorkingDir := range []string{".", "subhello"} {
+		serverGzip = relativeWorkingDir == "subhello"
+		resp := runForTestWith(t, runClientFunc, DriverRequest{}, relativeWorkingDir, "./...")
+		if len(resp.Roots) == 0 {
+			t.Fatalf("Expected package roots from %s: %+v", relativeWorkingDir, resp)
+		}
+		if relativeWorkingDir == "subhello" {
+			if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//subhello:subhello") {
+				t.Errorf("Expected only //subhello:subhello as root: %+v", resp.Roots)
+			}
+		}
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newServer(false).serve(ctx, l)
+
+	// The requests arrive within the batch window: the first two are
+	// identical, and the third only differs in its patterns.
+	runBatchFunc := func(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+		request, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		patterns := [][]string{args, args, {"./subhello/..."}}
+		outs := make([]bytes.Buffer, len(patterns))
+		errs := make([]error, len(patterns))
+		var wg sync.WaitGroup
+		for i := range patterns {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				errs[i] = runClient(conn, bytes.NewReader(request), &outs[i], patterns[i])
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+
+		if !bytes.Equal(outs[0].Bytes(), outs[1].Bytes()) {
+			t.Errorf("Expected identical requests to get the same response")
+		}
+		var resp driverResponse
+		if err := json.Unmarshal(outs[2].Bytes(), &resp); err != nil {
+			return err
+		}
+		if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//subhello:subhello") {
+			t.Errorf("Expected only //subhello:subhello as root: %+v", resp.Roots)
+		}
+		_, err = out.Write(outs[0].Bytes())
+		return err
+	}
+
+	resp := runForTestWith(t, runBatchFunc, DriverRequest{}, ".", "./...")
+	if len(resp.Roots) < 2 {
+		t.Errorf("Expected the roots of all packages: %+v", resp.Roots)
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	s := newServer(true)
+	runAndRefresh := func(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+		if err := runWithState(ctx, s.state, in, out, args); err != nil {
+			return err
+		}
+		if n := s.refresh(ctx); n != 0 {
+			t.Errorf("Expected no query to refresh before any change, refreshed %d", n)
+		}
+		if err := touchFile(t, "subhello/subhello.go"); err != nil {
+			return err
+		}
+		if n := s.refresh(ctx); n != 1 {
+			t.Errorf("Expected the query to refresh after a change, refreshed %d", n)
+		}
+		return nil
+	}
+
+	resp := runForTestWith(t, runAndRefresh, DriverRequest{}, "subhello", "./...")
+	if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//subhello:subhello") {
+		t.Errorf("Expected only //subhello:subhello as root: %+v", resp.Roots)
+	}
+	if len(s.state.watched) != 1 {
+		t.Errorf("Expected the refreshed query to still be watched: %+v", s.state.watched)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	oldResponseCacheDir := responseCacheDir
+	oldBazelBin := bazelBin
+	responseCacheDir = t.TempDir()
+	defer func() {
+		responseCacheDir = oldResponseCacheDir
+		bazelBin = oldBazelBin
+	}()
+
+	resp := runForTest(t, DriverRequest{}, ".", "file=hello.go")
+	if len(resp.Roots) != 1 || !strings.HasSuffix(resp.Roots[0], "//:hello") {
+		t.Fatalf("Expected //:hello as the only root: %+v", resp.Roots)
+	}
+
+	// The identical query is answered from the cache, without bazel.
+	bazelBin = "/nonexistent/bazel"
+	cached := runForTest(t, DriverRequest{}, ".", "file=hello.go")
+	if !reflect.DeepEqual(resp.Roots, cached.Roots) || len(resp.Packages) != len(cached.Packages) {
+		t.Errorf("Expected the cached response to match:\n%+v\n%+v", resp, cached)
+	}
+
+	// Touching a source of the package invalidates the entry, which makes the
+	// driver invoke bazel again.
+	if err := touchFile(t, "hello.go"); err != nil {
+		t.Fatal(err)
+	}
+	var runErr error
+	runForTestWith(t, func(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+		if runErr = run(ctx, in, out, args); runErr != nil {
+			io.WriteString(out, "{}")
+		}
+		return nil
+	}, DriverRequest{}, ".", "file=hello.go")
+	if runErr == nil {
+		t.Error("Expected the cached response to be invalidated")
+	}
+}
+
+func TestResponseCacheRelocation(t *testing.T) {
+	dir := t.TempDir()
+	workspace := filepath.Join(dir, "workspace")
+	oldOutputBase := filepath.Join(dir, "old")
+	newOutputBase := filepath.Join(dir, "new")
+	jsonFile := filepath.Join(oldOutputBase, "execroot", "_main", "hello.pkg.json")
+	if err := os.MkdirAll(filepath.Dir(jsonFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jsonFile, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(workspace, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	response := func(outputBase string) []byte {
+		data, err := json.Marshal(FlatPackage{GoFiles: []string{filepath.Join(outputBase, "external", "dep", "dep.go")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	cache := newResponseCache(filepath.Join(dir, "cache"))
+	if err := cache.Put("key", response(oldOutputBase), workspace, oldOutputBase, []string{jsonFile}, nil); err != nil {
+		t.Fatal(err)
+	}
+	noBazel := func() (string, error) {
+		return "", fmt.Errorf("unexpected bazel info")
+	}
+	if data, ok := cache.Get("key", noBazel); !ok || !bytes.Equal(data, response(oldOutputBase)) {
+		t.Errorf("Expected the response in the recorded output base, got %s", data)
+	}
+
+	// Moving the output base only needs its new location.
+	if err := os.Rename(oldOutputBase, newOutputBase); err != nil {
+		t.Fatal(err)
+	}
+	data, ok := cache.Get("key", func() (string, error) { return newOutputBase, nil })
+	if !ok || !bytes.Equal(data, response(newOutputBase)) {
+		t.Errorf("Expected the response in the new output base, got %s", data)
+	}
+}
+
+func BenchmarkDecodePackages(b *testing.B) {
+	const numFiles = 10000
+	dir := b.TempDir()
+	jsonFiles := make([]string, numFiles)
+	for i := range jsonFiles {
+		pkg := FlatPackage{
+			ID:              fmt.Sprintf("@//pkg%d:pkg%d", i, i),
+			Name:            fmt.Sprintf("pkg%d", i),
+			PkgPath:         fmt.Sprintf("example.com/pkg%d", i),
+			GoFiles:         []string{fmt.Sprintf("__BAZEL_WORKSPACE__/pkg%d/pkg.go", i)},
+			CompiledGoFiles: []string{fmt.Sprintf("__BAZEL_WORKSPACE__/pkg%d/pkg.go", i)},
+			ExportFile:      fmt.Sprintf("__BAZEL_EXECROOT__/bazel-out/k8-fastbuild/bin/pkg%d/pkg%d.x", i, i),
+			Imports:         map[string]string{"fmt": "@io_bazel_rules_go//stdlib:fmt"},
+		}
+		data, err := json.Marshal(pkg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		jsonFiles[i] = filepath.Join(dir, fmt.Sprintf("pkg%d.pkg.json", i))
+		if err := os.WriteFile(jsonFiles[i], data, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				pkgs, err := decodePackages(jsonFiles, nil, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(pkgs) != numFiles {
+					b.Fatalf("Expected %d packages, got %d", numFiles, len(pkgs))
+				}
+			}
+		})
+	}
+}
+
+func TestBEPFileReadLocal(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "stderr")
+	if err := os.WriteFile(f, []byte("compile error"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Bazel writes Windows paths as file:///C:/...
+	uri := "file://" + filepath.ToSlash(f)
+	if !strings.HasPrefix(filepath.ToSlash(f), "/") {
+		uri = "file:///" + filepath.ToSlash(f)
+	}
+	for _, tc := range []struct {
+		uri    string
+		want   string
+		wantOk bool
+	}{
+		{uri: uri, want: "compile error", wantOk: true},
+		{uri: uri + ".missing"},
+		{uri: "bytestream://remote.example.com/blobs/0123/4"},
+	} {
+		if got, ok := (BEPFile{URI: tc.uri}).readLocal(); got != tc.want || ok != tc.wantOk {
+			t.Errorf("readLocal(%q) = %q, %v, want %q, %v", tc.uri, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
+
+func TestMoveTestFilesWithoutXTest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"foo.go":          "package foo\n",
+		"foo_test.go":     "package foo\n",
+		"foo_ext_test.go": "package foo_test\n",
+	}
+	var goFiles []string
+	for name, content := range files {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		goFiles = append(goFiles, f)
+	}
+	fp := &FlatPackage{
+		ID:              "//foo:foo_test",
+		Name:            "foo",
+		PkgPath:         "example.com/foo",
+		GoFiles:         goFiles,
+		CompiledGoFiles: goFiles,
+	}
+
+	// Without the external test package of the aspect, it is derived from fp.
+	xtest := fp.MoveTestFiles(nil, nil)
+	if xtest == nil {
+		t.Fatal("Expected an external test package")
+	}
+	if xtest.ID != "//foo:foo_test_xtest" || xtest.Name != "foo_test" || xtest.PkgPath != "example.com/foo_test" {
+		t.Errorf("Unexpected external test package: %+v", xtest)
+	}
+	if xtest.Imports["example.com/foo"] != fp.ID {
+		t.Errorf("Expected the external test package to import %s: %+v", fp.ID, xtest.Imports)
+	}
+	if len(xtest.GoFiles) != 1 || len(xtest.CompiledGoFiles) != 1 {
+		t.Errorf("Expected only foo_ext_test.go in the external test package: %+v", xtest)
+	}
+	assertSuffixesInList(t, xtest.GoFiles, "/foo_ext_test.go")
+	if len(fp.GoFiles) != 2 {
+		t.Errorf("Expected foo.go and foo_test.go to stay in the test package: %+v", fp.GoFiles)
+	}
+}
+
+func TestParseEmbedPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		name, src string
+		want      []string
+	}{
+		{
+			name: "unquoted",
+			src:  "package p\n\n//go:embed a.txt  b/*.txt\n//go:embedded d.txt\nvar f embed.FS\n",
+			want: []string{"a.txt", "b/*.txt"},
+		},
+		{
+			name: "quoted",
+			src:  "package p\n\n//go:embed \"with space.txt\" `raw.txt`\tc.txt\n//go:embed \"quote\\\".txt\" it's.txt\nvar f embed.FS\n",
+			want: []string{"with space.txt", "raw.txt", "c.txt", `quote".txt`, "it's.txt"},
+		},
+		{
+			name: "grouped",
+			src:  "package p\n\nvar (\n\t//go:embed a.txt\n\ta string\n)\n",
+			want: []string{"a.txt"},
+		},
+		{
+			name: "raw string",
+			src:  "package p\n\nconst s = `\n//go:embed a.txt\n`\n\nvar b string\n",
+		},
+		{
+			name: "block comment",
+			src:  "package p\n\n/*\n//go:embed a.txt\n*/\nvar b string\n",
+		},
+		{
+			name: "not above a var",
+			src:  "package p\n\n//go:embed a.txt\nfunc f() {}\n",
+		},
+	} {
+		if got := parseEmbedPatterns([]byte(tc.src)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: parseEmbedPatterns() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeWindowsPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{`C:\ws\foo.go`, `C:\ws\foo.go`},
+		{"c:/ws/foo.go", `C:\ws\foo.go`},
+		{"/C:/_bazel/execroot/ws/bazel-out/foo.pkg.json", `C:\_bazel\execroot\ws\bazel-out\foo.pkg.json`},
+		{`C:\_bazel\execroot\ws/bazel-out/foo.go`, `C:\_bazel\execroot\ws\bazel-out\foo.go`},
+		{`\\server\share\foo.go`, `\\server\share\foo.go`},
+		{"foo/bar.go", `foo\bar.go`},
+	} {
+		if got := normalizeWindowsPath(tc.path); got != tc.want {
+			t.Errorf("normalizeWindowsPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
 func runForTest(t *testing.T, driverRequest DriverRequest, relativeWorkingDir string, args ...string) driverResponse {
 	t.Helper()
+	return runForTestWith(t, run, driverRequest, relativeWorkingDir, args...)
+}
+
+func runForTestWith(t *testing.T, runFunc func(context.Context, io.Reader, io.Writer, []string) error, driverRequest DriverRequest, relativeWorkingDir string, args ...string) driverResponse {
+	t.Helper()
 
 	// Remove most environment variables, other than those on an allowlist.
 	//
@@ -389,7 +1430,7 @@ func runForTest(t *testing.T, driverRequest DriverRequest, relativeWorkingDir st
 	}
 	in := bytes.NewReader(driverRequestJson)
 	out := &bytes.Buffer{}
-	if err := run(context.Background(), in, out, args); err != nil {
+	if err := runFunc(context.Background(), in, out, args); err != nil {
 		t.Fatalf("running gopackagesdriver: %v", err)
 	}
 	var resp driverResponse
@@ -399,6 +1440,34 @@ func runForTest(t *testing.T, driverRequest DriverRequest, relativeWorkingDir st
 	return resp
 }
 
+// mustFindPackage returns the package with the given id, failing the test if
+// there is none.
+func mustFindPackage(t *testing.T, packages []*FlatPackage, id string) *FlatPackage {
+	t.Helper()
+	pkg := findPackageByID(packages, id)
+	if pkg == nil {
+		t.Fatalf("Expected to find %q in resp.Packages", id)
+	}
+	return pkg
+}
+
+// touchFile moves the modification time of the file an hour ahead. The
+// fixture is shared by all the tests, so the time is restored at the end of
+// the test.
+func touchFile(t *testing.T, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	t.Cleanup(func() {
+		if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+			t.Errorf("restoring the modification time of %s: %v", file, err)
+		}
+	})
+	later := time.Now().Add(time.Hour)
+	return os.Chtimes(file, later, later)
+}
+
 func assertSuffixesInList(t *testing.T, list []string, expectedSuffixes ...string) {
 	t.Helper()
 	for _, suffix := range expectedSuffixes {
@@ -17,29 +17,35 @@ package main
 import (
 	"fmt"
 	"runtime"
+	"sync"
 )
 
+// decodeWorkers is how many package JSON files are read and decoded at once.
+var decodeWorkers = runtime.GOMAXPROCS(0)
+
 type JSONPackagesDriver struct {
 	registry *PackageRegistry
 }
 
-func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc, bazelVersion bazelVersion, overlays map[string][]byte) (*JSONPackagesDriver, error) {
+// NewJSONPackagesDriver loads the packages from jsonFiles. cache may be nil,
+// in which case every file is decoded.
+func NewJSONPackagesDriver(jsonFiles []string, cache *pkgJSONCache, prf PathResolverFunc, bazelVersion bazelVersion, overlays map[string][]byte) (*JSONPackagesDriver, error) {
 	jpd := &JSONPackagesDriver{
 		registry: NewPackageRegistry(bazelVersion),
 	}
 
-	for _, f := range jsonFiles {
-		if err := WalkFlatPackagesFromJSON(f, func(pkg *FlatPackage) {
-			jpd.registry.Add(pkg)
-		}); err != nil {
-			return nil, fmt.Errorf("unable to walk json: %w", err)
-		}
+	pkgs, err := decodePackages(jsonFiles, cache, decodeWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk json: %w", err)
 	}
+	jpd.registry.Add(pkgs...)
 
 	if err := jpd.registry.ResolvePaths(prf); err != nil {
 		return nil, fmt.Errorf("unable to resolve paths: %w", err)
 	}
 
+	jpd.registry.ResolveModules(prf("__BAZEL_WORKSPACE__"), prf("__BAZEL_OUTPUT_BASE__"))
+
 	if err := jpd.registry.ResolveImports(overlays); err != nil {
 		return nil, fmt.Errorf("unable to resolve imports: %w", err)
 	}
@@ -47,8 +53,83 @@ func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc, bazelVersio
 	return jpd, nil
 }
 
-func (b *JSONPackagesDriver) GetResponse(labels []string) *driverResponse {
-	rootPkgs, packages := b.registry.Match(labels)
+// decodePackages decodes the packages in jsonFiles using up to workers
+// goroutines. On large workspaces there are thousands of files, and decoding
+// them dominates the time spent after the build. The packages are returned in
+// the order of jsonFiles, so that the result doesn't depend on scheduling.
+func decodePackages(jsonFiles []string, cache *pkgJSONCache, workers int) ([]*FlatPackage, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jsonFiles) {
+		workers = len(jsonFiles)
+	}
+
+	pkgsByFile := make([][]*FlatPackage, len(jsonFiles))
+	errs := make([]error, len(jsonFiles))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = cache.Walk(jsonFiles[i], func(pkg *FlatPackage) {
+					pkgsByFile[i] = append(pkgsByFile[i], pkg)
+				})
+			}
+		}()
+	}
+	for i := range jsonFiles {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	var pkgs []*FlatPackage
+	for i, filePkgs := range pkgsByFile {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		pkgs = append(pkgs, filePkgs...)
+	}
+	return pkgs, nil
+}
+
+// AddBuildErrors reports the output of the actions that failed while building
+// the packages in their Errors.
+func (b *JSONPackagesDriver) AddBuildErrors(failed []FailedAction) {
+	b.registry.AddBuildErrors(failed)
+}
+
+// LinkGeneratedFiles makes the generated sources of the packages available as
+// symlinks in dir.
+func (b *JSONPackagesDriver) LinkGeneratedFiles(dir string) error {
+	return b.registry.LinkGeneratedFiles(dir)
+}
+
+// SourceFiles returns the files of all loaded packages. It must be called
+// before GetResponse, which drops the files the request has no use for.
+func (b *JSONPackagesDriver) SourceFiles() []string {
+	return b.registry.SourceFiles()
+}
+
+// GetResponse returns the packages matching labels. Fields that are not needed
+// for mode are dropped from the response; a zero mode, as sent by clients that
+// don't set one, keeps everything.
+func (b *JSONPackagesDriver) GetResponse(labels []string, stdlibRoots []string, mode LoadMode) *driverResponse {
+	rootPkgs, packages := b.registry.Match(labels, stdlibRoots)
+
+	if mode != 0 {
+		if mode.implied()&NeedImports == 0 {
+			// Without the import graph, go/packages has no use for anything
+			// but the roots.
+			packages = rootPackages(packages, rootPkgs)
+		}
+		for _, pkg := range packages {
+			pkg.Prune(mode)
+		}
+	}
 
 	return &driverResponse{
 		NotHandled: false,
@@ -58,3 +139,13 @@ func (b *JSONPackagesDriver) GetResponse(labels []string) *driverResponse {
 		Packages:   packages,
 	}
 }
+
+func rootPackages(packages []*FlatPackage, roots []string) []*FlatPackage {
+	ret := make([]*FlatPackage, 0, len(roots))
+	for _, pkg := range packages {
+		if contains(roots, pkg.ID) {
+			ret = append(ret, pkg)
+		}
+	}
+	return ret
+}
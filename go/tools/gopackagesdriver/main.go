@@ -15,11 +15,14 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
@@ -49,6 +52,10 @@ type driverResponse struct {
 	// Imports will be connected and then type and syntax information added in a
 	// later pass (see refine).
 	Packages []*FlatPackage
+
+	// Capabilities describes what the driver supports. It isn't part of
+	// go/packages, which ignores it.
+	Capabilities *driverCapabilities `json:",omitempty"`
 }
 
 var (
@@ -62,69 +69,379 @@ var (
 	bazelQueryFlags       = strings.Fields(os.Getenv("GOPACKAGESDRIVER_BAZEL_QUERY_FLAGS"))
 	bazelQueryScope       = getenvDefault("GOPACKAGESDRIVER_BAZEL_QUERY_SCOPE", "")
 	bazelBuildFlags       = strings.Fields(os.Getenv("GOPACKAGESDRIVER_BAZEL_BUILD_FLAGS"))
+	bazelDefaultQuery     = os.Getenv("GOPACKAGESDRIVER_BAZEL_QUERY")
+	bazelVariant          = os.Getenv("GOPACKAGESDRIVER_VARIANT")
+	bazelPathMode         = os.Getenv("GOPACKAGESDRIVER_PATHS")
 	workspaceRoot         = os.Getenv("BUILD_WORKSPACE_DIRECTORY")
 	buildWorkingDirectory = os.Getenv("BUILD_WORKING_DIRECTORY")
 	additionalAspects     = strings.Fields(os.Getenv("GOPACKAGESDRIVER_BAZEL_ADDTL_ASPECTS"))
 	additionalKinds       = strings.Fields(os.Getenv("GOPACKAGESDRIVER_BAZEL_KINDS"))
+	generatedFilesDir     = os.Getenv("GOPACKAGESDRIVER_GENERATED_FILES_DIR")
 	emptyResponse         = &driverResponse{
-		NotHandled: true,
-		Compiler:   "gc",
-		Arch:       runtime.GOARCH,
-		Roots:      []string{},
-		Packages:   []*FlatPackage{},
+		NotHandled:   true,
+		Compiler:     "gc",
+		Arch:         runtime.GOARCH,
+		Roots:        []string{},
+		Packages:     []*FlatPackage{},
+		Capabilities: currentCapabilities(),
 	}
 )
 
 func run(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
-	queries := args
+	return runWithState(ctx, nil, in, out, args)
+}
 
-	request, err := ReadDriverRequest(in)
+// runWithState handles a single request, reusing what state holds from
+// previous requests.
+func runWithState(ctx context.Context, state *warmState, in io.Reader, out io.Writer, args []string) error {
+	requestData, err := io.ReadAll(in)
 	if err != nil {
 		return fmt.Errorf("unable to read request: %w", err)
 	}
+	q := &driverQuery{args: args, out: out}
+	if err := runQueries(ctx, state, requestData, []*driverQuery{q}); err != nil {
+		return err
+	}
+	return q.err
+}
+
+// driverQuery is one of the queries answered together by runQueries: the
+// driver arguments it was sent with and where its response goes.
+type driverQuery struct {
+	args []string
+	out  io.Writer
+
+	patterns []string
+	labels   []string
+	// err is set when this query failed without affecting the others.
+	err error
+}
+
+// runQueries answers queries that share requestData and differ at most in
+// their patterns, such as the overlapping queries gopls sends on startup. Each
+// query is looked up on its own, since its response only has the packages it
+// matches, but a single build and load serves all of them. An error returned
+// applies to every query that has not answered yet.
+func runQueries(ctx context.Context, state *warmState, requestData []byte, queries []*driverQuery) (err error) {
+	// The queries share their flags, so those of the first one, which also
+	// labels the profile, apply to all of them.
+	var flags driverFlags
+	for i, q := range queries {
+		var queryFlags driverFlags
+		q.patterns, queryFlags = splitDriverFlags(q.args)
+		if i == 0 {
+			flags = queryFlags
+		}
+	}
 
-	bazel, err := NewBazel(ctx, bazelBin, workspaceRoot, buildWorkingDirectory, bazelCommonFlags, bazelStartupFlags)
+	// pprof.StartCPUProfile is process-global: this relies on the server
+	// holding its mutex while it runs queries, so that profiles never overlap.
+	profile, err := startDebugProfile(flags.debugProfile, queries[0].args)
 	if err != nil {
-		return fmt.Errorf("unable to create bazel instance: %w", err)
+		return err
 	}
+	defer func() { profile.finish(err) }()
 
-	bazelJsonBuilder, err := NewBazelJSONBuilder(bazel, request.Tests)
+	request, err := ReadDriverRequest(bytes.NewReader(requestData))
 	if err != nil {
-		return fmt.Errorf("unable to build JSON files: %w", err)
+		return fmt.Errorf("unable to read request: %w", err)
+	}
+
+	// bazel is created on first use, which may be a cache entry recorded with
+	// an output base that is gone.
+	var bazel *Bazel
+	getBazel := func() (*Bazel, error) {
+		if bazel != nil {
+			return bazel, nil
+		}
+		done := profile.phase("bazel info")
+		defer done()
+		b, err := state.getBazel(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create bazel instance: %w", err)
+		}
+		bazel = b
+		return bazel, nil
+	}
+	outputBase := func() (string, error) {
+		b, err := getBazel()
+		if err != nil {
+			return "", err
+		}
+		return b.OutputBase(), nil
 	}
 
-	labels, err := bazelJsonBuilder.Labels(ctx, queries)
+	cache := newResponseCache(responseCacheDir)
+	var pending []*driverQuery
+	for _, q := range queries {
+		if data, ok := cache.Get(cache.Key(q.args, requestData), outputBase); ok {
+			_, q.err = q.out.Write(data)
+			continue
+		}
+		pending = append(pending, q)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if _, err := getBazel(); err != nil {
+		return err
+	}
+
+	rewritePath, err := pathRewriter(flags.paths, bazel.WorkspaceRoot(), bazel.ExecutionRoot())
 	if err != nil {
-		return fmt.Errorf("unable to lookup package: %w", err)
+		return err
+	}
+
+	tags := flags.tags
+	if tags == nil {
+		tags = requestBuildTags(request)
+	}
+	bazelJsonBuilder, err := NewBazelJSONBuilder(bazel, request.Tests, flags.variant, tags)
+	if err != nil {
+		return fmt.Errorf("unable to build JSON files: %w", err)
+	}
+	buildContext = makeBuildContext(flags.variant, tags)
+
+	done := profile.phase("query")
+	var labels []string
+	seenLabels := map[string]struct{}{}
+	handled := pending[:0]
+	for _, q := range pending {
+		patterns := bazelJsonBuilder.HandledRequests(q.patterns)
+		if len(patterns) == 0 && len(q.patterns) > 0 {
+			// go/packages falls back to go list when the driver doesn't
+			// handle a request, which is what files outside of the workspace
+			// need.
+			data, err := json.Marshal(emptyResponse)
+			if err != nil {
+				q.err = fmt.Errorf("unable to marshal response: %v", err)
+			} else {
+				_, q.err = q.out.Write(data)
+			}
+			continue
+		}
+		q.patterns = patterns
+		q.labels, q.err = bazelJsonBuilder.Labels(ctx, q.patterns)
+		if q.err != nil {
+			q.err = fmt.Errorf("unable to lookup package: %w", q.err)
+			continue
+		}
+		for _, label := range q.labels {
+			if _, ok := seenLabels[label]; !ok {
+				seenLabels[label] = struct{}{}
+				labels = append(labels, label)
+			}
+		}
+		handled = append(handled, q)
+	}
+	done()
+	pending = handled
+	if len(pending) == 0 {
+		return nil
 	}
 
-	jsonFiles, err := bazelJsonBuilder.Build(ctx, labels, request.Mode)
+	done = profile.phase("build")
+	jsonFiles, failedActions, err := bazelJsonBuilder.Build(ctx, labels, request.Mode)
+	done()
 	if err != nil {
 		return fmt.Errorf("unable to build JSON files: %w", err)
 	}
 
-	driver, err := NewJSONPackagesDriver(jsonFiles, bazelJsonBuilder.PathResolver(), bazel.version, request.Overlay)
+	// From here on, the phase running when returning is ended by the deferred
+	// call, so that the response phase includes writing the response.
+	done = profile.phase("load")
+	defer func() { done() }()
+	driver, err := NewJSONPackagesDriver(jsonFiles, state.jsonCache(), bazelJsonBuilder.PathResolver(), bazel.version, request.Overlay)
 	if err != nil {
 		return fmt.Errorf("unable to load JSON files: %w", err)
 	}
+	driver.AddBuildErrors(failedActions)
+	if generatedFilesDir != "" {
+		// Relative to the workspace, like the convenience symlinks.
+		dir := generatedFilesDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(bazel.WorkspaceRoot(), dir)
+		}
+		if err := driver.LinkGeneratedFiles(dir); err != nil {
+			return fmt.Errorf("unable to link generated files: %w", err)
+		}
+	}
 
 	// Note: we are returning all files required to build a specific package.
 	// For file queries (`file=`), this means that the CompiledGoFiles will
 	// include more than the only file being specified.
-	resp := driver.GetResponse(labels)
-	data, err := json.Marshal(resp)
+	sizes, err := bazelJsonBuilder.Sizes()
+	if err != nil {
+		return fmt.Errorf("unable to load sizes: %w", err)
+	}
+
+	sourceFiles := driver.SourceFiles()
+	done()
+	done = profile.phase("response")
+	// The responses share their packages, which must only be rewritten once.
+	rewritten := map[*FlatPackage]struct{}{}
+	for _, q := range pending {
+		resp := driver.GetResponse(q.labels, bazelJsonBuilder.StdlibRoots(q.patterns), request.Mode)
+		resp.Compiler, resp.Arch = sizes.Compiler, sizes.Arch
+		resp.Capabilities = currentCapabilities()
+		if rewritePath != nil {
+			for _, pkg := range resp.Packages {
+				if _, ok := rewritten[pkg]; !ok {
+					rewritten[pkg] = struct{}{}
+					pkg.RewritePaths(rewritePath)
+				}
+			}
+		}
+		profile.count(jsonFiles, resp)
+
+		// Only keep a copy of the response in memory if it's going to be
+		// cached.
+		out := q.out
+		var cached *bytes.Buffer
+		if cache != nil {
+			cached = &bytes.Buffer{}
+			out = io.MultiWriter(out, cached)
+		}
+		if q.err = writeResponse(out, resp); q.err != nil {
+			continue
+		}
+		if cached != nil {
+			if err := cache.Put(cache.Key(q.args, requestData), cached.Bytes(), bazel.WorkspaceRoot(), bazel.OutputBase(), jsonFiles, sourceFiles); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to cache response: %v\n", err)
+			}
+		}
+		state.watch(q.args, requestData, bazel.WorkspaceRoot(), jsonFiles, sourceFiles)
+	}
+	return nil
+}
+
+// writeResponse encodes resp to w one package at a time. On large workspaces
+// the response is hundreds of megabytes, which encoding it at once would hold
+// in memory on top of the packages until it's written.
+func writeResponse(w io.Writer, resp *driverResponse) error {
+	// Everything but the packages is encoded upfront. Packages is added as
+	// the last field by replacing the closing brace.
+	head := struct {
+		NotHandled   bool
+		Compiler     string
+		Arch         string
+		Roots        []string            `json:",omitempty"`
+		Capabilities *driverCapabilities `json:",omitempty"`
+	}{resp.NotHandled, resp.Compiler, resp.Arch, resp.Roots, resp.Capabilities}
+	data, err := json.Marshal(head)
 	if err != nil {
 		return fmt.Errorf("unable to marshal response: %v", err)
 	}
-	_, err = out.Write(data)
-	return err
+
+	bw := bufio.NewWriter(w)
+	bw.Write(data[:len(data)-1])
+	bw.WriteString(`,"Packages":[`)
+	for i, pkg := range resp.Packages {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		data, err := json.Marshal(pkg)
+		if err != nil {
+			return fmt.Errorf("unable to marshal package %s: %v", pkg.ID, err)
+		}
+		if _, err := bw.Write(data); err != nil {
+			return fmt.Errorf("unable to write response: %w", err)
+		}
+	}
+	bw.WriteString("]}")
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("unable to write response: %w", err)
+	}
+	return nil
+}
+
+// variantFlag selects the build variant to report, like
+// GOPACKAGESDRIVER_VARIANT. Wrapper scripts pass it before the patterns.
+const variantFlag = "--variant="
+
+// tagsFlag sets the comma separated build tags to build and report the
+// packages with, overriding the -tags flag in the request.
+const tagsFlag = "--tags="
+
+// pathsFlag selects how file paths are reported, like GOPACKAGESDRIVER_PATHS.
+// See pathRewriter for the accepted values.
+const pathsFlag = "--paths="
+
+// driverFlags are the settings wrapper scripts can pass before the patterns.
+type driverFlags struct {
+	variant string
+	// tags is nil if the flags don't set any.
+	tags         []string
+	paths        string
+	debugProfile string
+}
+
+// splitDriverFlags separates the patterns in args from the settings they
+// select, which default to those of the environment.
+func splitDriverFlags(args []string) ([]string, driverFlags) {
+	flags := driverFlags{variant: bazelVariant, paths: bazelPathMode}
+	patterns := make([]string, 0, len(args))
+	for _, arg := range args {
+		if v, ok := strings.CutPrefix(arg, variantFlag); ok {
+			flags.variant = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(arg, tagsFlag); ok {
+			flags.tags = strings.FieldsFunc(v, func(r rune) bool { return r == ',' })
+			if flags.tags == nil {
+				flags.tags = []string{}
+			}
+			continue
+		}
+		if v, ok := strings.CutPrefix(arg, pathsFlag); ok {
+			flags.paths = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(arg, debugProfileFlag); ok {
+			flags.debugProfile = v
+			continue
+		}
+		patterns = append(patterns, arg)
+	}
+	return patterns, flags
 }
 
 func main() {
 	ctx, cancel := signalContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	if err := run(ctx, os.Stdin, os.Stdout, os.Args[1:]); err != nil {
+	if cfg, err := loadConfig(configDir()); err != nil {
+		fmt.Fprintf(os.Stderr, "Ignoring configuration file: %v\n", err)
+	} else {
+		cfg.apply()
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == diagnoseCommand {
+		if err := diagnose(ctx, os.Stdout, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == capabilitiesFlag {
+		if err := writeCapabilities(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && (os.Args[1] == serveFlag || os.Args[1] == watchFlag) {
+		if err := serveSocket(ctx, serverSocket, os.Args[1] == watchFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := runOrForward(ctx, os.Stdin, os.Stdout, os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v", err)
 		// gopls will check the packages driver exit code, and if there is an
 		// error, it will fall back to go list. Obviously we don't want that,
@@ -0,0 +1,166 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FlatPackageModule is the JSON form of packages.Module, restricted to what
+// can be known from the go.mod files.
+type FlatPackageModule struct {
+	Path      string `json:",omitempty"`
+	Version   string `json:",omitempty"`
+	Main      bool   `json:",omitempty"`
+	Dir       string `json:",omitempty"`
+	GoMod     string `json:",omitempty"`
+	GoVersion string `json:",omitempty"`
+}
+
+// goModFile holds the directives of a go.mod file that the driver reports.
+type goModFile struct {
+	Module    string
+	GoVersion string
+	// Require maps module paths to their required versions.
+	Require map[string]string
+}
+
+// parseGoMod reads the module, go and require directives of a go.mod file.
+// Anything else, including malformed lines, is ignored: a response without
+// module information is still useful.
+func parseGoMod(data []byte) *goModFile {
+	mf := &goModFile{Require: map[string]string{}}
+	inRequire := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if inRequire {
+			if fields[0] == ")" {
+				inRequire = false
+			} else if len(fields) >= 2 {
+				mf.Require[unquoteModPath(fields[0])] = fields[1]
+			}
+			continue
+		}
+		switch fields[0] {
+		case "module":
+			if len(fields) >= 2 {
+				mf.Module = unquoteModPath(fields[1])
+			}
+		case "go":
+			if len(fields) >= 2 {
+				mf.GoVersion = fields[1]
+			}
+		case "require":
+			if len(fields) >= 2 && fields[1] == "(" {
+				inRequire = true
+			} else if len(fields) >= 3 {
+				mf.Require[unquoteModPath(fields[1])] = fields[2]
+			}
+		}
+	}
+	return mf
+}
+
+func unquoteModPath(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// moduleResolver finds the modules of packages from the go.mod files above
+// their sources. Only go.mod files inside the workspace or inside an external
+// repository are considered, so that generated files in the execution root
+// aren't attributed to whatever go.mod it happens to link to.
+type moduleResolver struct {
+	workspace string
+	external  string
+	main      *goModFile
+	byDir     map[string]*FlatPackageModule
+}
+
+func newModuleResolver(workspace, outputBase string) *moduleResolver {
+	r := &moduleResolver{
+		workspace: workspace,
+		external:  filepath.Join(outputBase, "external"),
+		byDir:     map[string]*FlatPackageModule{},
+	}
+	if data, err := os.ReadFile(filepath.Join(workspace, "go.mod")); err == nil {
+		r.main = parseGoMod(data)
+	}
+	return r
+}
+
+// Module returns the module of the package with sources in dir, or nil if it
+// isn't in one.
+func (r *moduleResolver) Module(dir string) *FlatPackageModule {
+	root := r.searchRoot(dir)
+	if root == "" {
+		return nil
+	}
+	return r.lookup(dir, root)
+}
+
+func (r *moduleResolver) lookup(dir, root string) *FlatPackageModule {
+	if m, ok := r.byDir[dir]; ok {
+		return m
+	}
+	var m *FlatPackageModule
+	goMod := filepath.Join(dir, "go.mod")
+	if data, err := os.ReadFile(goMod); err == nil {
+		mf := parseGoMod(data)
+		m = &FlatPackageModule{
+			Path:      mf.Module,
+			Main:      root == r.workspace,
+			Dir:       dir,
+			GoMod:     goMod,
+			GoVersion: mf.GoVersion,
+		}
+		if !m.Main && r.main != nil {
+			m.Version = r.main.Require[m.Path]
+		}
+	} else if dir != root {
+		m = r.lookup(filepath.Dir(dir), root)
+	}
+	r.byDir[dir] = m
+	return m
+}
+
+// searchRoot returns the directory the search for the go.mod of dir stops at:
+// the workspace root or the root of the external repository dir is in.
+func (r *moduleResolver) searchRoot(dir string) string {
+	if isInDir(dir, r.workspace) {
+		return r.workspace
+	}
+	rel, err := filepath.Rel(r.external, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	repo, _, _ := strings.Cut(rel, string(filepath.Separator))
+	return filepath.Join(r.external, repo)
+}
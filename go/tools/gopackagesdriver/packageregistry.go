@@ -17,6 +17,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -67,19 +69,179 @@ func (pr *PackageRegistry) ResolveImports(overlays map[string][]byte) error {
 		return ""
 	}
 
+	// Vendored packages are reported under the import path their importers
+	// use; their IDs and export files still refer to the vendored archives.
+	for _, pkg := range pr.packagesByID {
+		if !pkg.IsStdlib() {
+			pkg.PkgPath = stripVendorPrefix(pkg.PkgPath)
+		}
+	}
+
+	pr.addOverlayFiles(overlays)
+
+	// Split off external test files first, so that each package only resolves
+	// the imports of its own files.
+	for _, pkg := range pr.packagesByID {
+		if pkg.IsStdlib() || pr.isXTest(pkg) {
+			continue
+		}
+		xtestID := pkg.ID + "_xtest"
+		xtest := pr.packagesByID[xtestID]
+		if testFp := pkg.MoveTestFiles(xtest, overlays); testFp != nil {
+			pr.packagesByID[testFp.ID] = testFp
+		} else if xtest != nil {
+			// The aspect reports an external test package for every go_test,
+			// even when it has no files.
+			delete(pr.packagesByID, xtestID)
+		}
+	}
+
 	for _, pkg := range pr.packagesByID {
 		if err := pkg.ResolveImports(resolve, overlays); err != nil {
 			return err
 		}
-		testFp := pkg.MoveTestFiles()
-		if testFp != nil {
-			pr.packagesByID[testFp.ID] = testFp
+		pkg.ResolveEmbedPatterns(overlays)
+	}
+
+	return nil
+}
+
+// addOverlayFiles adds the overlay files that don't exist on disk, such as new
+// unsaved editor buffers, to the packages in their directory. go/packages
+// reads the contents of all overlay files itself, so only the file lists need
+// to change. Like the rest of the response, overlay paths must be absolute.
+func (pr *PackageRegistry) addOverlayFiles(overlays map[string][]byte) {
+	for file := range overlays {
+		if !filepath.IsAbs(file) || filepath.Ext(file) != ".go" {
+			continue
+		}
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		name, err := parsePackageName(file, overlays)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(file)
+		isTest := strings.HasSuffix(file, "_test.go")
+		for _, pkg := range pr.packagesByID {
+			if pkg.IsStdlib() || containsPath(pkg.GoFiles, file) || !pkg.acceptsOverlayFile(dir, name, isTest, overlays) {
+				continue
+			}
+			pkg.GoFiles = append(pkg.GoFiles, file)
+			pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, file)
 		}
 	}
+}
 
+// isXTest reports whether pkg is the external test package of another package
+// in the registry.
+func (pr *PackageRegistry) isXTest(pkg *FlatPackage) bool {
+	id, ok := strings.CutSuffix(pkg.ID, "_xtest")
+	if !ok {
+		return false
+	}
+	_, ok = pr.packagesByID[id]
+	return ok
+}
+
+// LinkGeneratedFiles replaces the generated sources of all packages with
+// symlinks in dir, see FlatPackage.LinkGeneratedFiles.
+func (pr *PackageRegistry) LinkGeneratedFiles(dir string) error {
+	for _, pkg := range pr.packagesByID {
+		if err := pkg.LinkGeneratedFiles(dir); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ResolveModules sets the Module of the packages that have a go.mod above
+// their sources, in the workspace or in their external repository.
+func (pr *PackageRegistry) ResolveModules(workspace, outputBase string) {
+	r := newModuleResolver(workspace, outputBase)
+	for _, pkg := range pr.packagesByID {
+		if pkg.IsStdlib() || len(pkg.GoFiles) == 0 {
+			continue
+		}
+		pkg.Module = r.Module(filepath.Dir(pkg.GoFiles[0]))
+	}
+}
+
+// buildErrorRe matches the positioned errors printed by the compiler and by
+// analyzers, such as "pkg/file.go:12:5: undefined: x".
+var buildErrorRe = regexp.MustCompile(`^(\S+\.go):(\d+)(?::(\d+))?: (.+)$`)
+
+// AddBuildErrors adds the errors printed by the failed actions to the packages
+// of the targets that ran them. A positioned error goes to the package with
+// that file, which for a go_test may be its external test package.
+func (pr *PackageRegistry) AddBuildErrors(failed []FailedAction) {
+	for _, action := range failed {
+		pkg := pr.packagesByID[pr.canonicalID(action.Label)]
+		if pkg == nil {
+			continue
+		}
+		candidates := []*FlatPackage{pkg}
+		if xtest := pr.packagesByID[pkg.ID+"_xtest"]; xtest != nil {
+			candidates = append(candidates, xtest)
+		}
+
+		positioned := false
+		for _, line := range strings.Split(action.Stderr, "\n") {
+			m := buildErrorRe.FindStringSubmatch(strings.TrimSpace(line))
+			if m == nil {
+				continue
+			}
+			positioned = true
+			target, file := pkg, m[1]
+			for _, c := range candidates {
+				if f := c.fileWithSuffix(m[1]); f != "" {
+					target, file = c, f
+					break
+				}
+			}
+			pos := file + ":" + m[2]
+			if m[3] != "" {
+				pos += ":" + m[3]
+			}
+			target.Errors = append(target.Errors, FlatPackagesError{
+				Pos:  pos,
+				Msg:  m[4],
+				Kind: TypeError,
+			})
+		}
+		if !positioned {
+			if msg := strings.TrimSpace(action.Stderr); msg != "" {
+				pkg.Errors = append(pkg.Errors, FlatPackagesError{Msg: msg, Kind: UnknownError})
+			}
+		}
+	}
+}
+
+// canonicalID returns the ID of the package for label, which may be spelled
+// with a different number of leading @ than the IDs in the registry.
+func (pr *PackageRegistry) canonicalID(label string) string {
+	label = strings.TrimLeft(label, "@")
+	for id := range pr.packagesByID {
+		if strings.TrimLeft(id, "@") == label {
+			return id
+		}
+	}
+	return ""
+}
+
+// SourceFiles returns the files of every package in the registry.
+func (pr *PackageRegistry) SourceFiles() []string {
+	var files []string
+	for _, pkg := range pr.packagesByID {
+		files = append(files, pkg.GoFiles...)
+		files = append(files, pkg.CompiledGoFiles...)
+		files = append(files, pkg.OtherFiles...)
+		files = append(files, pkg.IgnoredFiles...)
+	}
+	return files
+}
+
 func (pr *PackageRegistry) walk(acc map[string]*FlatPackage, root string) {
 	pkg := pr.packagesByID[root]
 
@@ -96,7 +258,22 @@ func (pr *PackageRegistry) walk(acc map[string]*FlatPackage, root string) {
 	}
 }
 
-func (pr *PackageRegistry) Match(labels []string) ([]string, []*FlatPackage) {
+func (pr *PackageRegistry) isStdlibRoot(pkg *FlatPackage, stdlibRoots []string) bool {
+	if len(stdlibRoots) == 0 {
+		return true
+	}
+	for _, pattern := range stdlibRoots {
+		if matchesImportPattern(pattern, pkg.PkgPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the root package IDs for labels, along with every package
+// reachable from them. If stdlibRoots is non-empty, only the standard library
+// packages matching those import paths are roots when the stdlib is requested.
+func (pr *PackageRegistry) Match(labels []string, stdlibRoots []string) ([]string, []*FlatPackage) {
 	roots := map[string]struct{}{}
 
 	for _, label := range labels {
@@ -111,15 +288,18 @@ func (pr *PackageRegistry) Match(labels []string) ([]string, []*FlatPackage) {
 			// For stdlib, we need to append all the subpackages as roots
 			// since RulesGoStdLibLabel doesn't actually show up in the stdlib pkg.json
 			for _, pkg := range pr.packagesByID {
-				if pkg.Standard {
+				if pkg.Standard && pr.isStdlibRoot(pkg, stdlibRoots) {
 					roots[pkg.ID] = struct{}{}
 				}
 			}
 		} else {
 			roots[label] = struct{}{}
-			// If an xtest package exists for this package add it to the roots
-			if _, ok := pr.packagesByID[label+"_xtest"]; ok {
-				roots[label+"_xtest"] = struct{}{}
+			// If this is a test, add the other packages of the test binary to
+			// the roots, like go list -test does.
+			for _, suffix := range []string{"_xtest", "_testmain"} {
+				if _, ok := pr.packagesByID[label+suffix]; ok {
+					roots[label+suffix] = struct{}{}
+				}
 			}
 		}
 	}
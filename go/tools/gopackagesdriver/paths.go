@@ -0,0 +1,132 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Path modes, selecting how the file paths of packages are reported.
+const (
+	// pathModeAbsolute reports sources in the workspace and generated files
+	// in the execution root. It's the default.
+	pathModeAbsolute = "absolute"
+	// pathModeExecroot reports sources in the workspace through their
+	// symlinks in the execution root, which is what tools running inside
+	// Bazel actions see.
+	pathModeExecroot = "execroot"
+	// pathModeRelative reports the files in the workspace relative to it,
+	// for setups where the editor runs on another machine than the driver.
+	pathModeRelative = "relative"
+	// pathModeResolved reports all files with symlinks resolved, such as when
+	// the workspace itself is reached through a symlink.
+	pathModeResolved = "resolved"
+)
+
+// pathRewriter returns the function rewriting the absolute paths the driver
+// works with into those reported for mode, or nil if they are reported as is.
+func pathRewriter(mode, workspace, execroot string) (PathResolverFunc, error) {
+	switch mode {
+	case "", pathModeAbsolute:
+		return nil, nil
+	case pathModeExecroot:
+		return func(p string) string {
+			if rel, err := filepath.Rel(workspace, p); err == nil && isInDir(p, workspace) {
+				return filepath.Join(execroot, rel)
+			}
+			return p
+		}, nil
+	case pathModeRelative:
+		return func(p string) string {
+			if rel, err := filepath.Rel(workspace, p); err == nil && isInDir(p, workspace) {
+				return rel
+			}
+			return p
+		}, nil
+	case pathModeResolved:
+		return func(p string) string {
+			if resolved, err := filepath.EvalSymlinks(p); err == nil {
+				return normalizePath(resolved)
+			}
+			return p
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown path mode %q, expected %s, %s, %s or %s", mode, pathModeAbsolute, pathModeExecroot, pathModeRelative, pathModeResolved)
+	}
+}
+
+// normalizePath returns p in the form the driver reports file paths in. The
+// aspect and bazel info join paths with forward slashes, which doesn't matter
+// on Unix but produces mixed separators on Windows, where go/packages and
+// editors expect backslashes and compare paths as they are.
+func normalizePath(p string) string {
+	if runtime.GOOS != "windows" {
+		return p
+	}
+	return normalizeWindowsPath(p)
+}
+
+// normalizeWindowsPath converts the separators of p to backslashes, removes
+// the slash file URIs put in front of the drive letter ("/C:/foo") and upper
+// cases the drive letter, which editors send in either case.
+func normalizeWindowsPath(p string) string {
+	p = strings.ReplaceAll(p, "/", `\`)
+	if len(p) >= 3 && p[0] == '\\' && isDriveLetter(p[1]) && p[2] == ':' {
+		p = p[1:]
+	}
+	if len(p) >= 2 && isDriveLetter(p[0]) && p[1] == ':' {
+		p = strings.ToUpper(p[:1]) + p[1:]
+	}
+	return p
+}
+
+func isDriveLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// samePath reports whether a and b name the same file. File names are case
+// insensitive on Windows.
+func samePath(a, b string) bool {
+	if runtime.GOOS != "windows" {
+		return a == b
+	}
+	return strings.EqualFold(normalizeWindowsPath(a), normalizeWindowsPath(b))
+}
+
+// containsPath reports whether files contains a path naming the same file as f.
+func containsPath(files []string, f string) bool {
+	for _, file := range files {
+		if samePath(file, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeOverlay returns overlay with its file paths normalized, so that
+// they match the paths of the packages.
+func normalizeOverlay(overlay map[string][]byte) map[string][]byte {
+	if runtime.GOOS != "windows" || len(overlay) == 0 {
+		return overlay
+	}
+	ret := make(map[string][]byte, len(overlay))
+	for f, contents := range overlay {
+		ret[normalizeWindowsPath(f)] = contents
+	}
+	return ret
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// debugProfileFlag records where the time of a request goes in a new directory
+// under its value: a CPU and a heap profile, and summary.json with the time
+// spent in each phase and the size of the response.
+const debugProfileFlag = "--debug-profile="
+
+// debugProfile is the profile of a single request. A nil *debugProfile
+// records nothing.
+type debugProfile struct {
+	dir     string
+	start   time.Time
+	cpuFile *os.File
+	summary debugSummary
+}
+
+// debugSummary is written to summary.json. Durations are in nanoseconds.
+type debugSummary struct {
+	Args   []string
+	Phases []debugPhase
+	Total  time.Duration
+	// JSONFiles is the number of aspect outputs read, Packages and Files the
+	// number of packages in the responses and of their files.
+	JSONFiles int
+	Packages  int
+	Files     int
+	Error     string `json:",omitempty"`
+}
+
+// debugPhase is the time spent in a phase of a request, such as the bazel
+// query or the build of the aspect.
+type debugPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// startDebugProfile starts profiling a request into a new directory in dir, or
+// returns nil if dir is empty.
+func startDebugProfile(dir string, args []string) (*debugProfile, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create profile directory: %w", err)
+	}
+	// gopls runs the driver many times, so each request gets a directory.
+	reqDir, err := os.MkdirTemp(dir, time.Now().Format("20060102-150405-"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create profile directory: %w", err)
+	}
+	p := &debugProfile{dir: reqDir, start: time.Now(), summary: debugSummary{Args: args}}
+	cpuFile, err := os.Create(filepath.Join(reqDir, "cpu.pprof"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create CPU profile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(cpuFile); err != nil {
+		cpuFile.Close()
+		return nil, fmt.Errorf("unable to start CPU profile: %w", err)
+	}
+	p.cpuFile = cpuFile
+	return p, nil
+}
+
+// phase starts timing the phase name and returns the function ending it.
+func (p *debugProfile) phase(name string) func() {
+	if p == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		p.summary.Phases = append(p.summary.Phases, debugPhase{Name: name, Duration: time.Since(start)})
+	}
+}
+
+// count records the size of the response built from jsonFiles.
+func (p *debugProfile) count(jsonFiles []string, resp *driverResponse) {
+	if p == nil {
+		return
+	}
+	p.summary.JSONFiles = len(jsonFiles)
+	p.summary.Packages += len(resp.Packages)
+	for _, pkg := range resp.Packages {
+		p.summary.Files += len(pkg.GoFiles) + len(pkg.OtherFiles)
+	}
+}
+
+// finish stops profiling and writes the heap profile and the summary. err is
+// the error the request failed with, if any.
+func (p *debugProfile) finish(err error) {
+	if p == nil {
+		return
+	}
+	pprof.StopCPUProfile()
+	p.cpuFile.Close()
+
+	p.summary.Total = time.Since(p.start)
+	if err != nil {
+		p.summary.Error = err.Error()
+	}
+	if err := p.writeHeapProfile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write heap profile: %v\n", err)
+	}
+	data, err := json.MarshalIndent(p.summary, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(p.dir, "summary.json"), data, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write profile summary: %v\n", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Wrote profile to", p.dir)
+}
+
+func (p *debugProfile) writeHeapProfile() error {
+	f, err := os.Create(filepath.Join(p.dir, "heap.pprof"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Bring the statistics up to date with the end of the request.
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
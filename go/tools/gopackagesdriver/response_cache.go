@@ -0,0 +1,332 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// responseCacheDir enables the on-disk response cache when set.
+var responseCacheDir = os.Getenv("GOPACKAGESDRIVER_CACHE_DIR")
+
+// responseCacheVersion is part of every cache key. Bump it when the format of
+// the cache entries or of the response changes.
+const responseCacheVersion = 3
+
+// outputBasePlaceholder stands for the output base in cache entries, so that
+// they stay valid when it moves.
+const outputBasePlaceholder = "__BAZEL_OUTPUT_BASE__"
+
+// workspaceFiles are the files outside of any package that affect the
+// configuration of the whole build when they change.
+var workspaceFiles = []string{
+	".bazelrc",
+	".bazelversion",
+	"MODULE.bazel",
+	"MODULE.bazel.lock",
+	"WORKSPACE",
+	"WORKSPACE.bazel",
+	"WORKSPACE.bzlmod",
+}
+
+// responseCache stores assembled driver responses on disk, so that repeated
+// identical queries are answered without invoking bazel. An entry is only used
+// as long as the aspect outputs it was built from are unchanged, and the
+// BUILD files, sources and source directories of its workspace packages have
+// the same size and modification time. Changes to .bzl files outside of those
+// packages are not detected; remove the cache directory after editing them.
+//
+// Paths in the output base are stored relative to it. When the output base an
+// entry was recorded with is gone, such as after bazel clean --expunge or on a
+// CI runner restoring the cache to another directory, they are checked and
+// reported against the current one instead.
+//
+// A nil *responseCache caches nothing.
+type responseCache struct {
+	dir string
+}
+
+type responseCacheEntry struct {
+	Response   json.RawMessage
+	Files      []fileFingerprint
+	OutputBase string
+}
+
+// fileFingerprint records the state of a file an entry depends on. Aspect
+// outputs are compared by Digest, everything else by Size and ModTime. A
+// missing file has a Size of -1, so that creating it invalidates the entry.
+type fileFingerprint struct {
+	Path    string
+	Size    int64
+	ModTime int64  `json:",omitempty"`
+	Digest  string `json:",omitempty"`
+}
+
+func newResponseCache(dir string) *responseCache {
+	if dir == "" {
+		return nil
+	}
+	return &responseCache{dir: dir}
+}
+
+// Key returns the cache key of a request: the patterns in args, the request
+// itself and the flags and aspects of the bazel invocations. Which bazel binary
+// runs them is left out, as its effect shows in the aspect outputs.
+func (c *responseCache) Key(args []string, request []byte) string {
+	if c == nil {
+		return ""
+	}
+	return requestKey(args, request)
+}
+
+func requestKey(args []string, request []byte) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(struct {
+		Version               int
+		Args                  []string
+		Request               []byte
+		StartupFlags          []string
+		CommonFlags           []string
+		QueryFlags            []string
+		QueryScope            string
+		BuildFlags            []string
+		DefaultQuery          string
+		Variant               string
+		PathMode              string
+		Aspects               []string
+		Kinds                 []string
+		GeneratedFilesDir     string
+		WorkspaceRoot         string
+		BuildWorkingDirectory string
+	}{
+		Version:               responseCacheVersion,
+		Args:                  args,
+		Request:               request,
+		StartupFlags:          bazelStartupFlags,
+		CommonFlags:           bazelCommonFlags,
+		QueryFlags:            bazelQueryFlags,
+		QueryScope:            bazelQueryScope,
+		BuildFlags:            bazelBuildFlags,
+		DefaultQuery:          bazelDefaultQuery,
+		Variant:               bazelVariant,
+		PathMode:              bazelPathMode,
+		Aspects:               append([]string{goDefaultAspect}, additionalAspects...),
+		Kinds:                 additionalKinds,
+		GeneratedFilesDir:     generatedFilesDir,
+		WorkspaceRoot:         workspaceRoot,
+		BuildWorkingDirectory: buildWorkingDirectory,
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the cached response for key, if there is an up to date one.
+// outputBase is only called to find the current output base if the recorded
+// one is gone, as it runs bazel info.
+func (c *responseCache) Get(key string, outputBase func() (string, error)) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry responseCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	root := entry.OutputBase
+	if _, err := os.Stat(root); err != nil {
+		if root, err = outputBase(); err != nil {
+			return nil, false
+		}
+	}
+	for i := range entry.Files {
+		entry.Files[i].Path = replacePathPrefix(entry.Files[i].Path, outputBasePlaceholder, root)
+	}
+	if !upToDate(entry.Files) {
+		return nil, false
+	}
+	return replaceJSONPathPrefix(entry.Response, outputBasePlaceholder, root), true
+}
+
+// Put stores response under key. jsonFiles are the aspect outputs it was built
+// from, and sourceFiles the files of its packages; only those in workspace are
+// tracked, along with their directories and BUILD files.
+func (c *responseCache) Put(key string, response []byte, workspace, outputBase string, jsonFiles, sourceFiles []string) error {
+	if c == nil {
+		return nil
+	}
+
+	files, err := trackedFiles(workspace, jsonFiles, sourceFiles)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		files[i].Path = replacePathPrefix(files[i].Path, outputBase, outputBasePlaceholder)
+	}
+	data, err := json.Marshal(responseCacheEntry{
+		Response:   replaceJSONPathPrefix(response, outputBase, outputBasePlaceholder),
+		Files:      files,
+		OutputBase: outputBase,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to marshal cache entry: %w", err)
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	// Write to a temporary file first, so that concurrent drivers never read
+	// a partial entry.
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create cache entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return fmt.Errorf("unable to write cache entry: %w", err)
+	}
+	return nil
+}
+
+func (c *responseCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// trackedFiles fingerprints the files a response depends on: the aspect
+// outputs in jsonFiles, the sourceFiles in workspace along with their
+// directories and BUILD files, and the workspaceFiles.
+func trackedFiles(workspace string, jsonFiles, sourceFiles []string) ([]fileFingerprint, error) {
+	var files []fileFingerprint
+	for _, f := range jsonFiles {
+		fp, err := fingerprint(f, true)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fp)
+	}
+
+	tracked := map[string]struct{}{}
+	for _, f := range workspaceFiles {
+		tracked[filepath.Join(workspace, f)] = struct{}{}
+	}
+	for _, f := range sourceFiles {
+		if !isInDir(f, workspace) {
+			continue
+		}
+		dir := filepath.Dir(f)
+		tracked[f] = struct{}{}
+		tracked[dir] = struct{}{}
+		tracked[filepath.Join(dir, "BUILD")] = struct{}{}
+		tracked[filepath.Join(dir, "BUILD.bazel")] = struct{}{}
+	}
+	paths := make([]string, 0, len(tracked))
+	for f := range tracked {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+	for _, f := range paths {
+		fp, err := fingerprint(f, false)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fp)
+	}
+	return files, nil
+}
+
+// upToDate reports whether none of files changed since they were fingerprinted.
+func upToDate(files []fileFingerprint) bool {
+	for _, want := range files {
+		got, err := fingerprint(want.Path, want.Digest != "")
+		if err != nil || got != want {
+			return false
+		}
+	}
+	return true
+}
+
+func fingerprint(path string, digest bool) (fileFingerprint, error) {
+	fp := fileFingerprint{Path: path}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		fp.Size = -1
+		return fp, nil
+	} else if err != nil {
+		return fp, fmt.Errorf("unable to stat %s: %w", path, err)
+	}
+	if !digest {
+		fp.Size = info.Size()
+		fp.ModTime = info.ModTime().UnixNano()
+		return fp, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fp, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fp, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	fp.Size = info.Size()
+	fp.Digest = hex.EncodeToString(h.Sum(nil))
+	return fp, nil
+}
+
+// replacePathPrefix replaces old with new if it is p or one of its parents.
+func replacePathPrefix(p, old, new string) string {
+	if p == old {
+		return new
+	}
+	if rest, ok := strings.CutPrefix(p, old+string(filepath.Separator)); ok {
+		return new + string(filepath.Separator) + rest
+	}
+	return p
+}
+
+// replaceJSONPathPrefix is replacePathPrefix for all the paths in the JSON
+// strings of data.
+func replaceJSONPathPrefix(data []byte, old, new string) []byte {
+	oldJSON, newJSON := jsonStringContents(old), jsonStringContents(new)
+	// The prefix must be followed by a separator, escaped on Windows, or by
+	// the end of the string.
+	for _, end := range []string{"/", `\\`, `"`} {
+		data = bytes.ReplaceAll(data, []byte(`"`+oldJSON+end), []byte(`"`+newJSON+end))
+	}
+	return data
+}
+
+// jsonStringContents returns s encoded as a JSON string, without the quotes.
+func jsonStringContents(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
@@ -0,0 +1,593 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveFlag starts the driver as a long-running server instead of answering a
+// single request. It listens on serverSocket, which other invocations of the
+// driver forward their requests to when it is set.
+const serveFlag = "--serve"
+
+// watchFlag starts the server like serveFlag, and additionally refreshes the
+// queries it answered whenever the files they depend on change.
+const watchFlag = "--watch"
+
+// watchInterval is how often the watching server checks for changes.
+const watchInterval = time.Second
+
+// serverBatchWindow is how long the server waits for more requests after one
+// arrives, so that the overlapping requests gopls sends on startup are
+// answered with a single build.
+var serverBatchWindow = 50 * time.Millisecond
+
+var serverSocket = os.Getenv("GOPACKAGESDRIVER_SERVER_SOCKET")
+
+// serverGzip makes clients ask the server for gzip compressed responses, which
+// is worth it when the socket is slower than compressing, such as when it's
+// forwarded from a remote machine.
+var serverGzip = os.Getenv("GOPACKAGESDRIVER_SERVER_GZIP") != ""
+
+// serverRequest is the message a client sends to the server: the driver
+// arguments, the go/packages request it read from stdin and the directory
+// relative patterns are resolved against.
+type serverRequest struct {
+	Args             []string
+	Request          json.RawMessage
+	WorkingDirectory string `json:",omitempty"`
+	// Gzip is set if the client accepts a gzip compressed response.
+	Gzip bool `json:",omitempty"`
+}
+
+// serverResponse is the header the server sends back. Unless it holds the
+// error that prevented the response, the go/packages response follows it on a
+// new line and runs until the connection is closed, so that neither side has
+// to hold it in memory.
+type serverResponse struct {
+	Error string `json:",omitempty"`
+	// Gzip is set if the response is gzip compressed.
+	Gzip bool `json:",omitempty"`
+}
+
+// serverResponseWriter writes the header of a successful response before the
+// first byte of it, so that errors can still be reported as long as nothing
+// was written.
+type serverResponseWriter struct {
+	conn    io.Writer
+	gzip    bool
+	zw      *gzip.Writer
+	started bool
+}
+
+func (w *serverResponseWriter) Write(p []byte) (int, error) {
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+	return w.conn.Write(p)
+}
+
+func (w *serverResponseWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	if err := json.NewEncoder(w.conn).Encode(serverResponse{Gzip: w.gzip}); err != nil {
+		return err
+	}
+	if w.gzip {
+		w.zw = gzip.NewWriter(w.conn)
+	}
+	return nil
+}
+
+// Close writes the header if the response is empty and flushes the
+// compressed stream.
+func (w *serverResponseWriter) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+// warmState is what's kept between requests in server mode. A nil *warmState
+// caches nothing, which is what a single invocation of the driver uses.
+type warmState struct {
+	bazel    *Bazel
+	pkgJSONs *pkgJSONCache
+
+	// watched holds the queries to refresh by their requestKey, or is nil when
+	// not watching.
+	watched map[string]*watchedQuery
+}
+
+// watchedQuery is a query answered by a watching server, along with the files
+// its response depends on.
+type watchedQuery struct {
+	args             []string
+	request          []byte
+	workingDirectory string
+	files            []fileFingerprint
+}
+
+func newWarmState(watch bool) *warmState {
+	s := &warmState{pkgJSONs: newPkgJSONCache()}
+	if watch {
+		s.watched = map[string]*watchedQuery{}
+	}
+	return s
+}
+
+func (s *warmState) getBazel(ctx context.Context) (*Bazel, error) {
+	if s != nil && s.bazel != nil {
+		// bazel info doesn't depend on the working directory of the request.
+		b := *s.bazel
+		b.buildWorkingDirectory = buildWorkingDirectory
+		return &b, nil
+	}
+	bazel, err := NewBazel(ctx, bazelBin, workspaceRoot, buildWorkingDirectory, bazelCommonFlags, bazelStartupFlags)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		s.bazel = bazel
+	}
+	return bazel, nil
+}
+
+func (s *warmState) jsonCache() *pkgJSONCache {
+	if s == nil {
+		return nil
+	}
+	return s.pkgJSONs
+}
+
+// watch records a query answered from jsonFiles and sourceFiles, so that it is
+// refreshed when they change.
+func (s *warmState) watch(args []string, request []byte, workspace string, jsonFiles, sourceFiles []string) {
+	if s == nil || s.watched == nil {
+		return
+	}
+	files, err := trackedFiles(workspace, jsonFiles, sourceFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to watch query: %v\n", err)
+		return
+	}
+	s.watched[requestKey(args, request)] = &watchedQuery{
+		args:             args,
+		request:          request,
+		workingDirectory: buildWorkingDirectory,
+		files:            files,
+	}
+}
+
+type server struct {
+	// mu serializes batches: they share the warm state, and Bazel only runs
+	// one command at a time in a workspace anyway.
+	mu    sync.Mutex
+	state *warmState
+
+	// batchMu guards batch, the requests waiting for the next batch to run.
+	batchMu sync.Mutex
+	batch   []*batchedRequest
+}
+
+// batchedRequest is a request waiting in a batch. Its error, if any, is sent
+// on done once the batch ran.
+type batchedRequest struct {
+	req  serverRequest
+	out  io.Writer
+	done chan error
+}
+
+func newServer(watch bool) *server {
+	return &server{state: newWarmState(watch)}
+}
+
+// serveSocket runs the server on a unix socket at path until ctx is done.
+func serveSocket(ctx context.Context, path string, watch bool) error {
+	if path == "" {
+		return fmt.Errorf("%s requires GOPACKAGESDRIVER_SERVER_SOCKET to be set", serveFlag)
+	}
+	// Remove the socket left behind by a previous server, if any.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", path, err)
+	}
+	defer os.Remove(path)
+	fmt.Fprintln(os.Stderr, "Serving on", path)
+	return newServer(watch).serve(ctx, l)
+}
+
+// serve answers the requests of clients connecting to l until ctx is done.
+func (s *server) serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	if s.state.watched != nil {
+		go s.watchLoop(ctx)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to accept connection: %w", err)
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var req serverRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		writeServerError(conn, fmt.Errorf("unable to decode server request: %w", err))
+		return
+	}
+
+	// The response is buffered so that it's written in large chunks, but
+	// otherwise streamed to the client as it's encoded.
+	bw := bufio.NewWriterSize(conn, 1<<20)
+	out := &serverResponseWriter{conn: bw, gzip: req.Gzip}
+	br := &batchedRequest{req: req, out: out, done: make(chan error, 1)}
+	s.enqueue(ctx, br)
+	if err := <-br.done; err != nil {
+		if !out.started {
+			writeServerError(conn, err)
+			return
+		}
+		// Part of the response was sent already. Closing the connection
+		// without the rest makes it invalid JSON to the client.
+		fmt.Fprintf(os.Stderr, "error: unable to write server response: %v\n", err)
+		return
+	}
+	if err := out.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to write server response: %v\n", err)
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to write server response: %v\n", err)
+	}
+}
+
+// enqueue adds br to the next batch, which runs serverBatchWindow after its
+// first request arrived, or once the running batch is done.
+func (s *server) enqueue(ctx context.Context, br *batchedRequest) {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	s.batch = append(s.batch, br)
+	if len(s.batch) == 1 {
+		time.AfterFunc(serverBatchWindow, func() { s.runBatch(ctx) })
+	}
+}
+
+// runBatch answers the requests waiting in the batch. Requests that only
+// differ in their patterns are answered by one runQueries, and identical
+// requests by a single query whose response is copied to all of them.
+func (s *server) runBatch(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Requests arriving from now on wait for the next batch.
+	s.batchMu.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.batchMu.Unlock()
+
+	oldBuildWorkingDirectory := buildWorkingDirectory
+	defer func() {
+		buildWorkingDirectory = oldBuildWorkingDirectory
+	}()
+
+	type group struct {
+		request          []byte
+		workingDirectory string
+		queries          []*driverQuery
+		// requests holds the requests answered by each of queries, and
+		// byArgs the index of the query answering the given arguments.
+		requests [][]*batchedRequest
+		byArgs   map[string]int
+	}
+	var groups []*group
+	groupsByKey := map[string]*group{}
+	for _, br := range batch {
+		key := batchKey(br.req)
+		g := groupsByKey[key]
+		if g == nil {
+			g = &group{request: br.req.Request, workingDirectory: br.req.WorkingDirectory, byArgs: map[string]int{}}
+			groupsByKey[key] = g
+			groups = append(groups, g)
+		}
+		args := strings.Join(br.req.Args, "\x00")
+		i, ok := g.byArgs[args]
+		if !ok {
+			i = len(g.queries)
+			g.byArgs[args] = i
+			g.queries = append(g.queries, &driverQuery{args: br.req.Args, out: &fanoutWriter{}})
+			g.requests = append(g.requests, nil)
+		}
+		fw := g.queries[i].out.(*fanoutWriter)
+		fw.writers = append(fw.writers, br.out)
+		fw.errs = append(fw.errs, nil)
+		g.requests[i] = append(g.requests[i], br)
+	}
+
+	for _, g := range groups {
+		buildWorkingDirectory = oldBuildWorkingDirectory
+		if g.workingDirectory != "" {
+			buildWorkingDirectory = g.workingDirectory
+		}
+		err := runQueries(ctx, s.state, g.request, g.queries)
+		for i, q := range g.queries {
+			fw := q.out.(*fanoutWriter)
+			for j, br := range g.requests[i] {
+				switch {
+				case err != nil:
+					br.done <- err
+				case q.err != nil:
+					br.done <- q.err
+				default:
+					br.done <- fw.errs[j]
+				}
+			}
+		}
+	}
+}
+
+// batchKey returns the key of the requests that can be answered together with
+// req: those with the same go/packages request, working directory and driver
+// flags.
+func batchKey(req serverRequest) string {
+	patterns, _ := splitDriverFlags(req.Args)
+	// The patterns are in the order of the arguments, so whatever isn't one
+	// is a flag.
+	var flags []string
+	for _, arg := range req.Args {
+		if len(patterns) > 0 && arg == patterns[0] {
+			patterns = patterns[1:]
+			continue
+		}
+		flags = append(flags, arg)
+	}
+	key, _ := json.Marshal(struct {
+		Request          json.RawMessage
+		WorkingDirectory string
+		Flags            []string
+	}{req.Request, req.WorkingDirectory, flags})
+	return string(key)
+}
+
+// fanoutWriter writes to all of writers that didn't fail yet, so that a client
+// going away doesn't fail the identical requests of others. It only fails
+// once all of them did.
+type fanoutWriter struct {
+	writers []io.Writer
+	errs    []error
+}
+
+func (w *fanoutWriter) Write(p []byte) (int, error) {
+	var err error
+	ok := false
+	for i, fw := range w.writers {
+		if w.errs[i] != nil {
+			err = w.errs[i]
+			continue
+		}
+		if _, w.errs[i] = fw.Write(p); w.errs[i] != nil {
+			err = w.errs[i]
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func writeServerError(conn io.Writer, err error) {
+	if err := json.NewEncoder(conn).Encode(serverResponse{Error: err.Error()}); err != nil {
+		fmt.Fprintf(os.Stderr, "error: unable to write server response: %v\n", err)
+	}
+}
+
+func (s *server) watchLoop(ctx context.Context) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refresh(ctx)
+		}
+	}
+}
+
+// refresh runs the watched queries again whose files changed, and returns how
+// many it ran. go/packages has no way to receive updates it didn't ask for, so
+// clients get the refreshed packages with their next request, which is then
+// answered from warm state. Bazel only re-runs the aspect on targets whose
+// actions changed, so a refresh costs about as much as the delta.
+func (s *server) refresh(ctx context.Context) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldBuildWorkingDirectory := buildWorkingDirectory
+	defer func() {
+		buildWorkingDirectory = oldBuildWorkingDirectory
+	}()
+
+	refreshed := 0
+	for key, q := range s.state.watched {
+		if upToDate(q.files) {
+			continue
+		}
+		// The query is recorded again once it succeeds. On failure, such as
+		// a broken BUILD file, it's dropped rather than retried on every tick;
+		// the next client request will watch it again.
+		delete(s.state.watched, key)
+		buildWorkingDirectory = q.workingDirectory
+		if err := runWithState(ctx, s.state, bytes.NewReader(q.request), io.Discard, q.args); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to refresh query %v: %v\n", q.args, err)
+			continue
+		}
+		refreshed++
+	}
+	return refreshed
+}
+
+// runClient forwards a request to the server at the other end of conn and
+// writes its response to out.
+func runClient(conn net.Conn, in io.Reader, out io.Writer, args []string) error {
+	defer conn.Close()
+
+	request, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("unable to read request: %w", err)
+	}
+	wd := buildWorkingDirectory
+	if wd == "" {
+		wd, _ = os.Getwd()
+	}
+	if err := json.NewEncoder(conn).Encode(serverRequest{Args: args, Request: request, WorkingDirectory: wd, Gzip: serverGzip}); err != nil {
+		return fmt.Errorf("unable to send request to server: %w", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	var resp serverResponse
+	if err := decoder.Decode(&resp); err != nil {
+		return fmt.Errorf("unable to read response from server: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	// The response follows the newline ending the header, part of which the
+	// decoder may have read already.
+	body := bufio.NewReader(io.MultiReader(decoder.Buffered(), conn))
+	if c, err := body.ReadByte(); err == nil && c != '\n' {
+		body.UnreadByte()
+	}
+	var r io.Reader = body
+	if resp.Gzip {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("unable to read response from server: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		return fmt.Errorf("unable to read response from server: %w", err)
+	}
+	return nil
+}
+
+// runOrForward forwards the request to the server if one is configured and
+// listening, and otherwise handles it in this process.
+func runOrForward(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+	if serverSocket == "" {
+		return run(ctx, in, out, args)
+	}
+	// The request is read upfront so it can still be handled here if the
+	// server can't be reached.
+	request, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("unable to read request: %w", err)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", serverSocket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Server unavailable, handling request in process: %v\n", err)
+		return run(ctx, bytes.NewReader(request), out, args)
+	}
+	return runClient(conn, bytes.NewReader(request), out, args)
+}
+
+// pkgJSONCache holds the packages decoded from .pkg.json files. Entries are
+// reused as long as the size and modification time of the file are unchanged.
+// It is safe for concurrent use.
+type pkgJSONCache struct {
+	mu      sync.Mutex
+	entries map[string]pkgJSONCacheEntry
+}
+
+type pkgJSONCacheEntry struct {
+	info os.FileInfo
+	pkgs []*FlatPackage
+}
+
+func newPkgJSONCache() *pkgJSONCache {
+	return &pkgJSONCache{entries: map[string]pkgJSONCacheEntry{}}
+}
+
+// Walk calls onPkg for every package in jsonFile like WalkFlatPackagesFromJSON.
+// Packages are copied, so onPkg may modify them.
+func (c *pkgJSONCache) Walk(jsonFile string, onPkg PackageFunc) error {
+	if c == nil {
+		return WalkFlatPackagesFromJSON(jsonFile, onPkg)
+	}
+
+	info, err := os.Stat(jsonFile)
+	if err != nil {
+		return fmt.Errorf("unable to stat package JSON file: %w", err)
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[jsonFile]
+	c.mu.Unlock()
+	if !ok || entry.info.Size() != info.Size() || !entry.info.ModTime().Equal(info.ModTime()) {
+		entry = pkgJSONCacheEntry{info: info}
+		if err := WalkFlatPackagesFromJSON(jsonFile, func(pkg *FlatPackage) {
+			entry.pkgs = append(entry.pkgs, pkg)
+		}); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.entries[jsonFile] = entry
+		c.mu.Unlock()
+	}
+
+	for _, pkg := range entry.pkgs {
+		onPkg(pkg.clone())
+	}
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
 func getenvDefault(key, defaultValue string) string {
@@ -65,6 +66,60 @@ func isLocalPattern(pattern string) bool {
 	return build.IsLocalImport(pattern) || filepath.IsAbs(pattern)
 }
 
+// isStdlibImportPath reports whether pattern looks like the import path of a
+// standard library package, such as "fmt" or "net/...". Like cmd/go, it
+// assumes that only standard library import paths have no dot in their first
+// path element, although workspace packages may use such paths too.
+func isStdlibImportPath(pattern string) bool {
+	if pattern == "" || pattern == "std" || pattern == "builtin" || isLocalPattern(pattern) {
+		return false
+	}
+	if strings.HasSuffix(pattern, ".go") || isTargetPattern(pattern) || strings.Contains(pattern, ":") {
+		return false
+	}
+	first, _, _ := strings.Cut(pattern, "/")
+	return !strings.Contains(first, ".")
+}
+
+// isInDir reports whether path is dir or inside of it.
+func isInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isTargetPattern reports whether pattern is a Bazel target pattern, such as
+// "//foo/..." or "@repo//:bar", rather than a Go package pattern.
+func isTargetPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "//") || strings.HasPrefix(pattern, "@")
+}
+
+// matchesImportPattern reports whether importPath is matched by pattern,
+// which is either an import path or an import path followed by "/...".
+func matchesImportPattern(pattern, importPath string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/..."); ok {
+		return importPath == prefix || strings.HasPrefix(importPath, prefix+"/")
+	}
+	return pattern == importPath
+}
+
+// targetPatternFromPath translates a workspace-relative directory, optionally
+// followed by "/...", into the equivalent Bazel target pattern. For example
+// "." becomes "//:*", "./..." becomes "//..." and "foo/..." becomes "//foo/...".
+func targetPatternFromPath(relPath string) string {
+	dir, recursive := strings.CutSuffix(relPath, "...")
+	dir = path.Clean(strings.TrimSuffix(dir, "/"))
+	if dir == "." {
+		dir = ""
+	}
+	if recursive {
+		if dir == "" {
+			return "//..."
+		}
+		return fmt.Sprintf("//%s/...", dir)
+	}
+	return fmt.Sprintf("//%s:*", dir)
+}
+
 func packageID(pattern string) string {
 	pattern = path.Clean(pattern)
 	if filepath.IsAbs(pattern) {
@@ -58,6 +58,16 @@ go_library(
     embedsrcs = ["c/.bzr/c.txt"],
     importpath = "embeds_vcs_dir",
 )
+
+go_library(
+    name = "embeds_other_module",
+    srcs = ["d/d.go"],
+    embedsrcs = [
+        "d/sub/go.mod",
+        "d/sub/d.txt",
+    ],
+    importpath = "embeds_other_module",
+)
 -- invalid.go --
 package invalid
 
@@ -96,6 +106,16 @@ import _ "embed"
 //go:embed .bzr
 var z string
 -- c/.bzr/c.txt --
+-- d/d.go --
+package a
+
+import _ "embed"
+
+//go:embed sub/d.txt
+var w string
+-- d/sub/go.mod --
+module sub
+-- d/sub/d.txt --
 `,
 	})
 }
@@ -124,6 +144,11 @@ func Test(t *testing.T) {
 			target: "//:embeds_vcs_dir",
 			want:   "could not embed .bzr: cannot embed directory .bzr: invalid name .bzr",
 		},
+		{
+			desc:   "embeds_other_module",
+			target: "//:embeds_other_module",
+			want:   "could not embed sub/d.txt: cannot embed file sub/d.txt: in different module",
+		},
 	} {
 		t.Run(test.desc, func(t *testing.T) {
 			err := bazel_testing.RunBazel("build", test.target)
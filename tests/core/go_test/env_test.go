@@ -35,3 +35,17 @@ func TestEnv(t *testing.T) {
 		t.Fatalf("Could not find file at env var $ZONEINFO (value: %v) at path %v: %v", v, path, err)
 	}
 }
+
+func TestEnvMakeVariable(t *testing.T) {
+	switch v := os.Getenv("COMPILATION_MODE"); v {
+	case "fastbuild", "dbg", "opt":
+	default:
+		t.Fatalf("COMPILATION_MODE env var was %q; want the value of the $(COMPILATION_MODE) make variable", v)
+	}
+}
+
+func TestEnvLiteralDollar(t *testing.T) {
+	if v, want := os.Getenv("LITERAL_DOLLAR"), "$HOME $(NOT_A_MAKE_VARIABLE)"; v != want {
+		t.Fatalf("LITERAL_DOLLAR env var was %q; want %q", v, want)
+	}
+}
@@ -0,0 +1,66 @@
+package fuzz_mode_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+	name = "fuzzed_test",
+	srcs = ["fuzzed_test.go"],
+	fuzz = "^FuzzLong$",
+	fuzztime = "60s",
+)
+-- fuzzed_test.go --
+package fuzzed
+
+import "testing"
+
+func FuzzLong(f *testing.F) {
+	f.Add([]byte("a"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) >= 4 {
+			t.Fatalf("input too long: %q", b)
+		}
+	})
+}
+`,
+	})
+}
+
+// TestFailingInputSaved checks that the input a fuzz target fails on is saved
+// to the undeclared outputs of the test.
+func TestFailingInputSaved(t *testing.T) {
+	if err := bazel_testing.RunBazel("test", "//:fuzzed_test", "--nozip_undeclared_test_outputs"); err == nil {
+		t.Fatal("expected the fuzz target to fail")
+	}
+	out, err := bazel_testing.BazelOutput("info", "bazel-testlogs")
+	if err != nil {
+		t.Fatalf("could not find testlog root: %s", err)
+	}
+	dir := filepath.Join(strings.TrimSpace(string(out)), "fuzzed_test", "test.outputs", "testdata", "fuzz", "FuzzLong")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not read saved fuzz inputs: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d saved fuzz inputs in %s; want 1", len(entries), dir)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "go test fuzz v1\n") {
+		t.Errorf("saved fuzz input isn't in the corpus format:\n%s", data)
+	}
+}
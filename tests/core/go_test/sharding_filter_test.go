@@ -0,0 +1,74 @@
+package sharding_filter_test
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+	name = "sharded_test",
+	srcs = ["sharded_test.go"],
+	shard_count = 2,
+)
+-- sharded_test.go --
+package sharded
+
+import "testing"
+
+func TestTaskA(t *testing.T) {}
+func TestFoo(t *testing.T) {}
+func TestTaskB(t *testing.T) {}
+func TestBar(t *testing.T) {}
+`,
+	})
+}
+
+type xmlTestSuites struct {
+	Suites []struct {
+		TestCases []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"testcase"`
+	} `xml:"testsuite"`
+}
+
+// TestFilteredShards checks that the tests left by --test_filter are spread
+// over the shards, rather than the tests in the package.
+func TestFilteredShards(t *testing.T) {
+	if err := bazel_testing.RunBazel("test", "//:sharded_test", "--test_env=GO_TEST_WRAP_TESTV=1", "--test_filter=^TestTask"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := bazel_testing.BazelOutput("info", "bazel-testlogs")
+	if err != nil {
+		t.Fatalf("could not find testlog root: %s", err)
+	}
+	for _, shard := range []string{"shard_1_of_2", "shard_2_of_2"} {
+		data, err := os.ReadFile(filepath.Join(strings.TrimSpace(string(out)), "sharded_test", shard, "test.xml"))
+		if err != nil {
+			t.Fatalf("could not read generated xml file: %s", err)
+		}
+		var suites xmlTestSuites
+		if err := xml.Unmarshal(data, &suites); err != nil {
+			t.Fatalf("could not unmarshall generated xml: %s", err)
+		}
+		var ran []string
+		for _, suite := range suites.Suites {
+			for _, tc := range suite.TestCases {
+				ran = append(ran, tc.Name)
+			}
+		}
+		if len(ran) != 1 || !strings.HasPrefix(ran[0], "TestTask") {
+			t.Errorf("%s ran %v; want one of TestTaskA and TestTaskB", shard, ran)
+		}
+	}
+}
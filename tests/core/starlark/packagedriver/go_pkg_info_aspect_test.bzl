@@ -15,12 +15,54 @@ package_driver_pkg_json_test = analysistest.make(
     extra_target_under_test_aspects = [go_pkg_info_aspect],
 )
 
+def _package_driver_xtest_pkg_json_test_impl(ctx):
+    env = analysistest.begin(ctx)
+
+    target_under_test = analysistest.target_under_test(env)
+    json_files = [f.basename for f in target_under_test[OutputGroupInfo].go_pkg_driver_json_file.to_list()]
+    asserts.true(env, "go_default_test_test.pkg.json" in json_files, "{} does not contain go_default_test_test.pkg.json".format(json_files))
+
+    return analysistest.end(env)
+
+package_driver_xtest_pkg_json_test = analysistest.make(
+    _package_driver_xtest_pkg_json_test_impl,
+    extra_target_under_test_aspects = [go_pkg_info_aspect],
+)
+
+def _package_driver_testmain_pkg_json_test_impl(ctx):
+    env = analysistest.begin(ctx)
+
+    target_under_test = analysistest.target_under_test(env)
+    json_files = [f.basename for f in target_under_test[OutputGroupInfo].go_pkg_driver_json_file.to_list()]
+    asserts.true(env, "go_default_test~testmain.pkg.json" in json_files, "{} does not contain go_default_test~testmain.pkg.json".format(json_files))
+
+    # The test main imports bzltestutil, so its package must be reported too.
+    # The contents of the files are checked by the gopackagesdriver tests.
+    asserts.true(env, "bzltestutil.pkg.json" in json_files, "{} does not contain bzltestutil.pkg.json".format(json_files))
+
+    return analysistest.end(env)
+
+package_driver_testmain_pkg_json_test = analysistest.make(
+    _package_driver_testmain_pkg_json_test_impl,
+    extra_target_under_test_aspects = [go_pkg_info_aspect],
+)
+
 def _test_package_driver():
     package_driver_pkg_json_test(
         name = "package_driver_should_return_pkg_json_for_go_test",
         target_under_test = "//tests/core/starlark/packagedriver/fixtures/c:go_default_test",
     )
 
+    package_driver_xtest_pkg_json_test(
+        name = "package_driver_should_return_xtest_pkg_json_for_go_test",
+        target_under_test = "//tests/core/starlark/packagedriver/fixtures/c:go_default_test",
+    )
+
+    package_driver_testmain_pkg_json_test(
+        name = "package_driver_should_return_testmain_pkg_json_for_go_test",
+        target_under_test = "//tests/core/starlark/packagedriver/fixtures/c:go_default_test",
+    )
+
 def package_driver_suite(name):
     _test_package_driver()
 
@@ -28,5 +70,7 @@ def package_driver_suite(name):
         name = name,
         tests = [
             ":package_driver_should_return_pkg_json_for_go_test",
+            ":package_driver_should_return_xtest_pkg_json_for_go_test",
+            ":package_driver_should_return_testmain_pkg_json_for_go_test",
         ],
     )
@@ -0,0 +1,54 @@
+load("@bazel_skylib//lib:unittest.bzl", "analysistest", "asserts")
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+def _wasip1_launcher_test(ctx):
+    env = analysistest.begin(ctx)
+
+    target = analysistest.target_under_test(env)
+    executable = target[DefaultInfo].files_to_run.executable
+    asserts.true(env, executable.basename.endswith("_wasip1.sh"), "expected a launcher script, got {}".format(executable.short_path))
+
+    wasm = [
+        f
+        for f in target[DefaultInfo].default_runfiles.files.to_list()
+        if f.basename == "wasip1_go_test"
+    ]
+    asserts.equals(env, 1, len(wasm), "expected the test binary in the runfiles")
+
+    writes = [
+        action
+        for action in analysistest.target_actions(env)
+        if action.mnemonic == "FileWrite" and executable in action.outputs.to_list()
+    ]
+    asserts.equals(env, 1, len(writes), "expected the launcher to be written")
+    if wasm and writes:
+        rlocationpath = ctx.workspace_name + "/" + wasm[0].short_path
+        asserts.true(
+            env,
+            'rlocation="{}"'.format(rlocationpath) in writes[0].content,
+            "expected the launcher to run {}:\n{}".format(rlocationpath, writes[0].content),
+        )
+
+    return analysistest.end(env)
+
+wasip1_launcher_test = analysistest.make(_wasip1_launcher_test)
+
+def wasip1_test_suite():
+    """Creates the test targets and test suite for wasip1 go_test tests."""
+    go_test(
+        name = "wasip1_go_test",
+        srcs = ["wasip1_test.go"],
+        goarch = "wasm",
+        goos = "wasip1",
+        tags = ["manual"],
+    )
+
+    wasip1_launcher_test(
+        name = "wasip1_launcher_test",
+        target_under_test = ":wasip1_go_test",
+    )
+
+    native.test_suite(
+        name = "wasip1_tests",
+        tests = [":wasip1_launcher_test"],
+    )
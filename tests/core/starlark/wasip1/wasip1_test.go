@@ -0,0 +1,5 @@
+package wasip1
+
+import "testing"
+
+func TestNothing(t *testing.T) {}